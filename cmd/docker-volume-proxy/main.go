@@ -5,21 +5,192 @@
 package main
 
 import (
+	"context"
+	"encoding/json"
 	"flag"
 	"fmt"
 	"github.com/titan-data/titan-docker-proxy/internal/forwarder"
 	"github.com/titan-data/titan-docker-proxy/internal/listener"
+	"github.com/titan-data/titan-docker-proxy/internal/logging"
 	"os"
+	"os/signal"
+	"sort"
+	"strings"
+	"syscall"
+	"time"
 )
 
+/*
+ * Reconciles mount state with titan-server at startup, and again every time we receive SIGHUP. This runs in the
+ * background, with each pass bounded by the timeout, so that a titan-server that is down or hung can never keep the
+ * proxy from serving requests or shutting down. Failures are only logged, and passes never overlap.
+ */
+func reconcile(forward forwarder.Forwarder, timeout time.Duration, logger *logging.Logger) {
+	reconciler, ok := forward.(forwarder.Reconciler)
+	if !ok {
+		return
+	}
+
+	run := func() {
+		ctx, cancel := context.WithTimeout(context.Background(), timeout)
+		defer cancel()
+		if err := reconciler.Reconcile(ctx); err != nil {
+			logger.Warn("reconcile failed", logging.Error(err))
+		}
+	}
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGHUP)
+	go func() {
+		run()
+		for range signals {
+			run()
+		}
+	}()
+}
+
+/*
+ * Logs how many requests shared each call to titan-server rather than making their own, every interval. The stats
+ * are cumulative, and only logged at debug level.
+ */
+func reportStats(forward forwarder.Forwarder, interval time.Duration, logger *logging.Logger) {
+	coalescer, ok := forward.(forwarder.Coalescer)
+	if !ok || interval <= 0 {
+		return
+	}
+
+	go func() {
+		for range time.Tick(interval) {
+			if !logger.Enabled(logging.LevelDebug) {
+				continue
+			}
+			stats := coalescer.CoalescingStats()
+			keys := []string{}
+			for key := range stats {
+				keys = append(keys, key)
+			}
+			sort.Strings(keys)
+			for _, key := range keys {
+				logger.Debug("request coalescing", logging.F("key", key), logging.F("calls", stats[key].Calls),
+					logging.F("coalesced", stats[key].Coalesced))
+			}
+		}
+	}()
+}
+
+/*
+ * Shuts the listener down on SIGTERM or SIGINT, giving requests in flight until the timeout to finish. Returns a
+ * channel that is closed once shutdown is complete, as Listen() returns as soon as it starts.
+ */
+func shutdown(listen listener.Listener, timeout time.Duration, logger *logging.Logger) chan struct{} {
+	stopped := make(chan struct{})
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, syscall.SIGINT)
+	go func() {
+		sig := <-signals
+		logger.Info("shutting down", logging.F("signal", sig.String()))
+
+		ctx, cancel := context.WithTimeout(context.Background(), timeout)
+		defer cancel()
+		if err := listen.Shutdown(ctx); err != nil {
+			logger.Error("shutdown failed", logging.Error(err))
+		}
+		close(stopped)
+	}()
+	return stopped
+}
+
+/*
+ * Collects repeated --path-rewrite from=to options.
+ */
+type pathRewrites []forwarder.PathRewrite
+
+func (r *pathRewrites) String() string {
+	return fmt.Sprintf("%v", *r)
+}
+
+func (r *pathRewrites) Set(value string) error {
+	parts := strings.SplitN(value, "=", 2)
+	if len(parts) != 2 {
+		return fmt.Errorf("path rewrite must be of the form <from>=<to>")
+	}
+	*r = append(*r, forwarder.PathRewrite{From: parts[0], To: parts[1]})
+	return nil
+}
+
+/*
+ * Loads a JSON configuration file on top of the given configuration. Unknown fields are rejected so that typos don't
+ * go unnoticed.
+ */
+func loadConfig(path string, config *forwarder.Config) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	decoder := json.NewDecoder(file)
+	decoder.DisallowUnknownFields()
+	if err = decoder.Decode(config); err != nil {
+		return fmt.Errorf("failed to parse config file %s: %w", path, err)
+	}
+	return nil
+}
+
+/*
+ * Where mount state is kept unless configured otherwise, so that a restarted proxy remembers which volumes are in use.
+ * The library itself defaults to keeping state only in memory.
+ */
+const defaultStatePath = "/var/lib/titan-docker-proxy/mounts.json"
+
 func main() {
 	flag.Usage = func() {
-		fmt.Fprintf(os.Stderr, "Usage: docker-volume-forwarder [--host host] [--port port] socket\n")
+		fmt.Fprintf(os.Stderr, "Usage: docker-volume-forwarder [--config file] [options] socket\n")
 		flag.PrintDefaults()
 	}
 
-	host := flag.String("host", "localhost", "host to connect to")
-	port := flag.Int("port", 5001, "port to connect to")
+	defaults := forwarder.DefaultConfig()
+	defaults.StatePath = defaultStatePath
+	configPath := flag.String("config", "", "JSON configuration file, overridden by any other options")
+	host := flag.String("host", defaults.Host, "host to connect to")
+	port := flag.Int("port", defaults.Port, "port to connect to")
+	state := flag.String("state", defaults.StatePath,
+		"file used to persist mount state across restarts (in-memory only if empty)")
+	policy := flag.String("reconcile", string(defaults.ReconcilePolicy),
+		"how to reconcile mount state with titan-server (none, reactivate, deactivate, full)")
+	reconcileTimeout := flag.Duration("reconcile-timeout", 2*time.Minute,
+		"how long each pass reconciling mount state with titan-server may take")
+	defaultRepo := flag.String("default-repository", defaults.DefaultRepository,
+		"repository to use for volume names without one")
+	naming := flag.String("naming", defaults.Naming.Scheme,
+		"volume naming scheme (slash, separator, or prefix; prefixes must be set in the config file)")
+	separator := flag.String("separator", defaults.Naming.Separator,
+		"separator between repository and volume for the separator naming scheme")
+
+	autoCreate := flag.Bool("auto-create-repository", defaults.AutoCreateRepository,
+		"create missing repositories when creating volumes")
+	checkMountpoints := flag.Bool("check-mountpoints", defaults.CheckMountpoints,
+		"check that mountpoints exist before returning them to docker")
+	rewrites := pathRewrites{}
+	flag.Var(&rewrites, "path-rewrite", "translate mountpoints from titan-server to host paths, as <from>=<to> "+
+		"(may be repeated)")
+	mountRoot := flag.String("mount-root", defaults.MountRoot, "directory that all mountpoints must be within")
+	partialList := flag.Bool("partial-list", defaults.Listing.Partial,
+		"list the volumes of healthy repositories even when others fail")
+	cacheTTL := flag.Duration("cache-ttl", time.Duration(defaults.Cache.TTL),
+		"how long to cache volume metadata (0 to disable)")
+	maxInFlight := flag.Int("max-in-flight", defaults.Limits.MaxInFlight,
+		"maximum number of concurrent calls to titan-server (0 for no limit)")
+	logLevel := flag.String("log-level", logging.LevelInfo.String(), "minimum level to log: debug, info, warn, error")
+	logFormat := flag.String("log-format", string(logging.FormatText), "log format: text or json")
+	logBodies := flag.Bool("log-bodies", false, "log request and response bodies (at debug level)")
+	maxRequestSize := flag.Int64("max-request-size", listener.DefaultMaxBodySize,
+		"largest request body to accept from docker, in bytes (0 for no limit)")
+	strictRequests := flag.Bool("strict-requests", false, "reject requests with unknown fields")
+	statsInterval := flag.Duration("stats-interval", 5*time.Minute,
+		"how often to log request coalescing stats at debug level (0 to disable)")
+	shutdownTimeout := flag.Duration("shutdown-timeout", 30*time.Second,
+		"how long to wait for requests in flight when shutting down")
 
 	flag.Parse()
 
@@ -29,14 +200,81 @@ func main() {
 	}
 	path := flag.Arg(0)
 
-	fmt.Printf("Proxying requests from %s to %s:%d\n", path, *host, *port)
+	level, err := logging.ParseLevel(*logLevel)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		os.Exit(2)
+	}
+	format, err := logging.ParseFormat(*logFormat)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		os.Exit(2)
+	}
+	logger := logging.New(os.Stderr, level, format)
+
+	config := defaults
+	if *configPath != "" {
+		if err := loadConfig(*configPath, &config); err != nil {
+			fmt.Fprintf(os.Stderr, "%v\n", err)
+			os.Exit(1)
+		}
+	}
 
-	forward := forwarder.New(*host, *port)
-	listen := listener.New(forward, path)
-	listen.SetLogging(true)
+	flag.Visit(func(f *flag.Flag) {
+		switch f.Name {
+		case "host":
+			config.Host = *host
+		case "port":
+			config.Port = *port
+		case "state":
+			config.StatePath = *state
+		case "reconcile":
+			config.ReconcilePolicy = forwarder.ReconcilePolicy(*policy)
+		case "default-repository":
+			config.DefaultRepository = *defaultRepo
+		case "naming":
+			config.Naming.Scheme = *naming
+		case "separator":
+			config.Naming.Separator = *separator
+		case "auto-create-repository":
+			config.AutoCreateRepository = *autoCreate
+		case "check-mountpoints":
+			config.CheckMountpoints = *checkMountpoints
+		case "path-rewrite":
+			config.PathRewrites = rewrites
+		case "mount-root":
+			config.MountRoot = *mountRoot
+		case "partial-list":
+			config.Listing.Partial = *partialList
+		case "cache-ttl":
+			config.Cache.TTL = forwarder.Duration(*cacheTTL)
+		case "max-in-flight":
+			config.Limits.MaxInFlight = *maxInFlight
+		}
+	})
+
+	config.Logger = logger
+	titan := fmt.Sprintf("%s:%d", config.Host, config.Port)
+	logger.Info("proxying requests", logging.F("socket", path), logging.F("titan", titan))
 
-	err := listen.Listen()
+	forward, err := forwarder.NewWithConfig(config)
 	if err != nil {
-		panic(err)
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		os.Exit(1)
+	}
+
+	listen := listener.New(forward, path)
+	listen.SetLogger(logger)
+	listen.SetLogging(*logBodies)
+	listen.SetMaxBodySize(*maxRequestSize)
+	listen.SetStrictDecoding(*strictRequests)
+
+	stopped := shutdown(listen, *shutdownTimeout, logger)
+	reconcile(forward, *reconcileTimeout, logger)
+	reportStats(forward, *statsInterval, logger)
+	if err = listen.Listen(); err != nil {
+		logger.Error("unable to serve requests", logging.Error(err))
+		os.Exit(1)
 	}
+	<-stopped
 }
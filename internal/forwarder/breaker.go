@@ -0,0 +1,176 @@
+/*
+ * Copyright The Titan Project Contributors.
+ */
+
+package forwarder
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/titan-data/titan-docker-proxy/internal/logging"
+	"net/http"
+	"sync"
+	"time"
+)
+
+/*
+ * When titan-server is down, every call would otherwise wait for a connection or request timeout, and docker commands
+ * like "docker volume ls" hang for minutes. The circuit breaker tracks consecutive failures across all calls, and once
+ * they reach the threshold it opens, failing calls immediately. After the open timeout it lets a limited number of
+ * probe calls through (half-open): a successful probe closes the circuit again, while a failed one re-opens it.
+ *
+ * Only failures that suggest titan-server is unhealthy count: connection errors, 5xx responses, and calls that hit
+ * their deadline. Errors reported by a healthy server (such as "no such volume") count as successes, and calls
+ * abandoned because docker canceled the request don't count at all.
+ */
+type BreakerConfig struct {
+	// Consecutive failures before the circuit opens. 0 disables the circuit breaker.
+	FailureThreshold int `json:"failureThreshold"`
+	// How long the circuit stays open before probing titan-server again
+	OpenTimeout Duration `json:"openTimeout"`
+	// Number of concurrent probe calls allowed while half-open
+	HalfOpenRequests int `json:"halfOpenRequests"`
+}
+
+func (c BreakerConfig) validate() error {
+	if c.FailureThreshold < 0 {
+		return errors.New("circuit breaker failure threshold cannot be negative")
+	}
+	if c.FailureThreshold > 0 && (c.OpenTimeout <= 0 || c.HalfOpenRequests < 1) {
+		return errors.New("circuit breaker requires a positive open timeout and at least one half-open request")
+	}
+	return nil
+}
+
+const (
+	CircuitClosed   = "closed"
+	CircuitOpen     = "open"
+	CircuitHalfOpen = "half-open"
+)
+
+type callOutcome int
+
+const (
+	callSucceeded callOutcome = iota
+	callFailed
+	callIgnored
+)
+
+func getCallOutcome(resp *http.Response, err error) callOutcome {
+	if err == nil || (resp != nil && resp.StatusCode < http.StatusInternalServerError) {
+		return callSucceeded
+	}
+	if errors.Is(err, context.Canceled) {
+		return callIgnored
+	}
+	return callFailed
+}
+
+type circuitBreaker struct {
+	lock     sync.Mutex
+	config   BreakerConfig
+	state    string
+	failures int
+	openedAt time.Time
+	probes   int
+	now      func() time.Time
+	log      *logging.Logger
+}
+
+func newCircuitBreaker(config BreakerConfig, log *logging.Logger) *circuitBreaker {
+	return &circuitBreaker{
+		config: config,
+		state:  CircuitClosed,
+		now:    time.Now,
+		log:    log,
+	}
+}
+
+/*
+ * Must be called with the lock held.
+ */
+func (b *circuitBreaker) transition(state string) {
+	if b.state == state {
+		return
+	}
+	switch state {
+	case CircuitOpen:
+		b.openedAt = b.now()
+		b.log.Warn("circuit breaker open, failing calls to titan-server", logging.F("failures", b.failures),
+			logging.F("openFor", time.Duration(b.config.OpenTimeout)))
+	case CircuitHalfOpen:
+		b.log.Info("circuit breaker half-open, probing titan-server")
+	case CircuitClosed:
+		b.log.Info("circuit breaker closed, titan-server is healthy")
+	}
+	b.state = state
+}
+
+/*
+ * Checks whether a call may proceed. Returns whether the call is a half-open probe, which must be passed back to
+ * record() along with the outcome of the call.
+ */
+func (b *circuitBreaker) allow() (bool, error) {
+	if b.config.FailureThreshold == 0 {
+		return false, nil
+	}
+
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	if b.state == CircuitOpen {
+		remaining := time.Duration(b.config.OpenTimeout) - b.now().Sub(b.openedAt)
+		if remaining > 0 {
+			return false, fmt.Errorf("titan-server is unavailable (circuit breaker open after %d consecutive "+
+				"failures, retrying in %s)", b.failures, remaining.Round(time.Second))
+		}
+		b.transition(CircuitHalfOpen)
+	}
+
+	if b.state == CircuitHalfOpen {
+		if b.probes >= b.config.HalfOpenRequests {
+			return false, errors.New("titan-server is unavailable (circuit breaker half-open, waiting for probe)")
+		}
+		b.probes++
+		return true, nil
+	}
+
+	return false, nil
+}
+
+func (b *circuitBreaker) record(probe bool, outcome callOutcome) {
+	if b.config.FailureThreshold == 0 {
+		return
+	}
+
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	if probe {
+		b.probes--
+	}
+
+	switch outcome {
+	case callSucceeded:
+		b.failures = 0
+		if probe {
+			b.transition(CircuitClosed)
+		}
+	case callFailed:
+		b.failures++
+		if probe {
+			// Re-opening resets the timer, so force the transition even though we never left the open state
+			b.state = CircuitHalfOpen
+			b.transition(CircuitOpen)
+		} else if b.state == CircuitClosed && b.failures >= b.config.FailureThreshold {
+			b.transition(CircuitOpen)
+		}
+	}
+}
+
+func (b *circuitBreaker) State() string {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	return b.state
+}
@@ -0,0 +1,119 @@
+/*
+ * Copyright The Titan Project Contributors.
+ */
+
+package forwarder
+
+import (
+	"context"
+	"errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/titan-data/titan-docker-proxy/internal/logging"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func testBreaker() (*circuitBreaker, *time.Time) {
+	now := time.Now()
+	config := BreakerConfig{FailureThreshold: 2, OpenTimeout: Duration(time.Minute), HalfOpenRequests: 1}
+	b := newCircuitBreaker(config, logging.Discard())
+	b.now = func() time.Time { return now }
+	return b, &now
+}
+
+func TestBreakerOpens(t *testing.T) {
+	b, _ := testBreaker()
+
+	for i := 0; i < 2; i++ {
+		probe, err := b.allow()
+		assert.NoError(t, err)
+		b.record(probe, callFailed)
+	}
+	assert.Equal(t, CircuitOpen, b.State())
+
+	_, err := b.allow()
+	if assert.Error(t, err) {
+		assert.Equal(t, "titan-server is unavailable (circuit breaker open after 2 consecutive failures, "+
+			"retrying in 1m0s)", err.Error())
+	}
+}
+
+func TestBreakerSuccessResets(t *testing.T) {
+	b, _ := testBreaker()
+
+	b.record(false, callFailed)
+	b.record(false, callSucceeded)
+	b.record(false, callFailed)
+	b.record(false, callIgnored)
+	assert.Equal(t, CircuitClosed, b.State())
+}
+
+func TestBreakerHalfOpen(t *testing.T) {
+	b, now := testBreaker()
+	b.record(false, callFailed)
+	b.record(false, callFailed)
+
+	*now = now.Add(time.Minute)
+	probe, err := b.allow()
+	assert.NoError(t, err)
+	assert.True(t, probe)
+	assert.Equal(t, CircuitHalfOpen, b.State())
+
+	_, err = b.allow()
+	assert.Error(t, err)
+
+	b.record(probe, callSucceeded)
+	assert.Equal(t, CircuitClosed, b.State())
+	_, err = b.allow()
+	assert.NoError(t, err)
+}
+
+func TestBreakerProbeFails(t *testing.T) {
+	b, now := testBreaker()
+	b.record(false, callFailed)
+	b.record(false, callFailed)
+
+	*now = now.Add(time.Minute)
+	probe, _ := b.allow()
+	b.record(probe, callFailed)
+	assert.Equal(t, CircuitOpen, b.State())
+
+	*now = now.Add(30 * time.Second)
+	_, err := b.allow()
+	assert.Error(t, err)
+}
+
+func TestBreakerDisabled(t *testing.T) {
+	b := newCircuitBreaker(BreakerConfig{}, logging.Discard())
+	for i := 0; i < 10; i++ {
+		b.record(false, callFailed)
+	}
+	_, err := b.allow()
+	assert.NoError(t, err)
+}
+
+func TestBreakerOutcome(t *testing.T) {
+	assert.Equal(t, callSucceeded, getCallOutcome(&http.Response{StatusCode: 404}, errors.New("not found")))
+	assert.Equal(t, callFailed, getCallOutcome(&http.Response{StatusCode: 503}, errors.New("unavailable")))
+	assert.Equal(t, callFailed, getCallOutcome(nil, errors.New("connection refused")))
+	assert.Equal(t, callFailed, getCallOutcome(nil, context.DeadlineExceeded))
+	assert.Equal(t, callIgnored, getCallOutcome(nil, context.Canceled))
+}
+
+func TestBreakerForwarder(t *testing.T) {
+	var count int32
+	config := retryConfig()
+	config.Retry.MaxAttempts = 1
+	config.Breaker.FailureThreshold = 2
+	f, teardown := testForwarderWithConfig(flakyHandler(100, http.StatusServiceUnavailable, &count), config)
+	defer teardown()
+
+	assert.Equal(t, "unavailable", f.GetVolume(context.Background(), VolumeRequest{Name: "foo/vol"}).Err)
+	assert.Equal(t, "unavailable", f.GetVolume(context.Background(), VolumeRequest{Name: "foo/vol"}).Err)
+	resp := f.GetVolume(context.Background(), VolumeRequest{Name: "foo/vol"})
+	assert.True(t, strings.HasPrefix(resp.Err, "titan-server is unavailable"))
+	assert.Equal(t, int32(2), atomic.LoadInt32(&count))
+}
@@ -0,0 +1,234 @@
+/*
+ * Copyright The Titan Project Contributors.
+ */
+
+package forwarder
+
+import (
+	"context"
+	"errors"
+	"github.com/titan-data/titan-docker-proxy/internal/logging"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+/*
+ * Docker calls Get and Path for a volume many times over the course of a single "docker run", and every call would
+ * otherwise be a round trip to titan-server. The cache sits in front of a forwarder and remembers successful Get, Path,
+ * and List responses for a short time. Create, Remove, Mount, and Unmount through the proxy invalidate what they
+ * touch; changes made directly against titan-server only show up once the TTL expires.
+ *
+ * If titan-server is unreachable, entries can keep being served for a bounded time past their TTL, so that a brief
+ * outage doesn't make docker believe that every volume has disappeared. Errors from a healthy server (such as "no
+ * such volume") are always passed through.
+ */
+type CacheConfig struct {
+	// How long responses are served from the cache. 0 disables caching.
+	TTL Duration `json:"ttl"`
+	// How long past their TTL responses may still be served while titan-server is unreachable
+	StaleTTL Duration `json:"staleTTL"`
+}
+
+func (c CacheConfig) validate() error {
+	if c.TTL < 0 || c.StaleTTL < 0 {
+		return errors.New("cache TTLs cannot be negative")
+	}
+	return nil
+}
+
+/*
+ * Records whether any titan-server call made on behalf of a request failed in a way that suggests titan-server is
+ * unhealthy, which is how the cache tells an outage apart from an ordinary error.
+ */
+type reachabilityKey struct{}
+
+type reachability struct {
+	unreachable int32
+}
+
+func withReachability(ctx context.Context) (context.Context, *reachability) {
+	r := &reachability{}
+	return context.WithValue(ctx, reachabilityKey{}, r), r
+}
+
+func markUnreachable(ctx context.Context) {
+	if r, ok := ctx.Value(reachabilityKey{}).(*reachability); ok {
+		atomic.StoreInt32(&r.unreachable, 1)
+	}
+}
+
+func (r *reachability) failed() bool {
+	return atomic.LoadInt32(&r.unreachable) != 0
+}
+
+var listCacheKey = requestKey(EndpointList, "")
+
+type cacheEntry struct {
+	value  interface{}
+	stored time.Time
+}
+
+type cachingForwarder struct {
+	Decorator
+	names NameResolver
+	ttl   time.Duration
+	stale time.Duration
+	now   func() time.Time
+	log   *logging.Logger
+
+	lock    sync.Mutex
+	entries map[string]cacheEntry
+	// Incremented on every invalidation, so that responses fetched before it are not cached after it
+	generation uint64
+	swept      time.Time
+}
+
+func newCachingForwarder(inner Forwarder, config CacheConfig, names NameResolver,
+	log *logging.Logger) *cachingForwarder {
+	return &cachingForwarder{
+		Decorator: Decorator{Next: inner},
+		names:     names,
+		log:       log,
+		ttl:       time.Duration(config.TTL),
+		stale:     time.Duration(config.StaleTTL),
+		now:       time.Now,
+		entries:   map[string]cacheEntry{},
+	}
+}
+
+/*
+ * Serves a response from the cache if it's fresh, and otherwise fetches it. The fetch function returns the response
+ * and its error string, and only successful responses are cached.
+ */
+func (c *cachingForwarder) cached(ctx context.Context, key string,
+	fetch func(ctx context.Context) (interface{}, string)) interface{} {
+	c.lock.Lock()
+	entry, ok := c.entries[key]
+	generation := c.generation
+	c.lock.Unlock()
+
+	now := c.now()
+	if ok && now.Sub(entry.stored) < c.ttl {
+		return entry.value
+	}
+
+	ctx, reach := withReachability(ctx)
+	value, err := fetch(ctx)
+	if err != "" {
+		if ok && reach.failed() && now.Sub(entry.stored) < c.ttl+c.stale {
+			c.log.Warn("titan-server is unreachable, serving cached response", logging.F("key", key),
+				logging.F("age", now.Sub(entry.stored).Round(time.Second)), logging.F("error", err))
+			return entry.value
+		}
+		return value
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.generation == generation {
+		c.entries[key] = cacheEntry{value: value, stored: now}
+	}
+	c.sweep(now)
+	return value
+}
+
+/*
+ * Drops entries that can no longer be served even while titan-server is unreachable, so that volumes removed behind
+ * our back don't accumulate. Must be called with the lock held.
+ */
+func (c *cachingForwarder) sweep(now time.Time) {
+	if now.Sub(c.swept) < c.ttl {
+		return
+	}
+	c.swept = now
+	for key, entry := range c.entries {
+		if now.Sub(entry.stored) >= c.ttl+c.stale {
+			delete(c.entries, key)
+		}
+	}
+}
+
+/*
+ * Volumes are cached under their canonical name, so that every name for a volume shares one entry, and changing the
+ * volume through one name invalidates them all.
+ */
+func (c *cachingForwarder) key(endpoint string, name string) string {
+	return requestKey(endpoint, canonicalName(c.names, name))
+}
+
+/*
+ * Forgets everything cached about a volume, as well as the volume list.
+ */
+func (c *cachingForwarder) invalidate(name string) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.generation++
+	delete(c.entries, c.key(EndpointGet, name))
+	delete(c.entries, c.key(EndpointPath, name))
+	delete(c.entries, listCacheKey)
+}
+
+func (c *cachingForwarder) invalidateAll() {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.generation++
+	c.entries = map[string]cacheEntry{}
+}
+
+func (c *cachingForwarder) GetVolume(ctx context.Context, request VolumeRequest) GetVolumeResponse {
+	resp := c.cached(ctx, c.key(EndpointGet, request.Name), func(ctx context.Context) (interface{}, string) {
+		resp := c.Next.GetVolume(ctx, request)
+		return resp, resp.Err
+	}).(GetVolumeResponse)
+	return withRequestName(resp, request.Name)
+}
+
+func (c *cachingForwarder) GetPath(ctx context.Context, request VolumeRequest) GetPathResponse {
+	return c.cached(ctx, c.key(EndpointPath, request.Name), func(ctx context.Context) (interface{}, string) {
+		resp := c.Next.GetPath(ctx, request)
+		return resp, resp.Err
+	}).(GetPathResponse)
+}
+
+func (c *cachingForwarder) ListVolumes(ctx context.Context) ListVolumeResponse {
+	return c.cached(ctx, listCacheKey, func(ctx context.Context) (interface{}, string) {
+		resp := c.Next.ListVolumes(ctx)
+		return resp, resp.Err
+	}).(ListVolumeResponse)
+}
+
+func (c *cachingForwarder) CreateVolume(ctx context.Context, request CreateVolumeRequest) VolumeResponse {
+	defer c.invalidate(request.Name)
+	return c.Next.CreateVolume(ctx, request)
+}
+
+func (c *cachingForwarder) RemoveVolume(ctx context.Context, request VolumeRequest) VolumeResponse {
+	defer c.invalidate(request.Name)
+	return c.Next.RemoveVolume(ctx, request)
+}
+
+func (c *cachingForwarder) MountVolume(ctx context.Context, request MountVolumeRequest) GetPathResponse {
+	defer c.invalidate(request.Name)
+	return c.Next.MountVolume(ctx, request)
+}
+
+func (c *cachingForwarder) UnmountVolume(ctx context.Context, request MountVolumeRequest) VolumeResponse {
+	defer c.invalidate(request.Name)
+	return c.Next.UnmountVolume(ctx, request)
+}
+
+/*
+ * Reconciliation can forget mounts and change activation state for any volume, so everything is invalidated once
+ * it finishes.
+ */
+func (c *cachingForwarder) Reconcile(ctx context.Context) error {
+	reconciler, ok := c.Next.(Reconciler)
+	if !ok {
+		return nil
+	}
+	defer c.invalidateAll()
+	return reconciler.Reconcile(ctx)
+}
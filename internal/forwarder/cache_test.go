@@ -0,0 +1,157 @@
+/*
+ * Copyright The Titan Project Contributors.
+ */
+
+package forwarder
+
+import (
+	"context"
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+/*
+ * Serves a volume, failing every request with the given status while it's non-zero.
+ */
+func cacheHandler(status *int32, count *int32) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(count, 1)
+		w.Header().Set("Content-Type", "application/json")
+		if s := atomic.LoadInt32(status); s != 0 {
+			w.WriteHeader(int(s))
+			w.Write([]byte("{\"message\":\"failed\"}"))
+			return
+		}
+		if r.Method == "POST" {
+			w.WriteHeader(http.StatusCreated)
+			w.Write([]byte("{}"))
+			return
+		}
+		w.Write([]byte("{\"name\":\"vol\",\"config\":{\"mountpoint\":\"/vol\"},\"properties\":{}}"))
+	})
+}
+
+func testCache(t *testing.T, status *int32, count *int32) (*cachingForwarder, *time.Time, func()) {
+	return testCacheWithConfig(t, status, count, DefaultConfig())
+}
+
+func testCacheWithConfig(t *testing.T, status *int32, count *int32, config Config) (*cachingForwarder, *time.Time,
+	func()) {
+	config.Retry.MaxAttempts = 1
+	config.Breaker.FailureThreshold = 0
+	config.Cache = CacheConfig{TTL: Duration(10 * time.Second), StaleTTL: Duration(time.Minute)}
+	f, teardown := testForwarderWithConfig(cacheHandler(status, count), config)
+
+	c, ok := f.(*cachingForwarder)
+	if !assert.True(t, ok) {
+		t.FailNow()
+	}
+	now := time.Now()
+	c.now = func() time.Time { return now }
+	return c, &now, teardown
+}
+
+func TestCacheDisabled(t *testing.T) {
+	f, _ := NewWithConfig(DefaultConfig())
+	_, ok := f.(forwarder)
+	assert.True(t, ok)
+}
+
+func TestCacheGet(t *testing.T) {
+	var status, count int32
+	c, now, teardown := testCache(t, &status, &count)
+	defer teardown()
+
+	resp := c.GetVolume(context.Background(), VolumeRequest{Name: "foo/vol"})
+	assert.Empty(t, resp.Err)
+	assert.Equal(t, "foo/vol", resp.Volume.Name)
+	resp = c.GetVolume(context.Background(), VolumeRequest{Name: "foo/vol"})
+	assert.Equal(t, "foo/vol", resp.Volume.Name)
+	assert.Equal(t, int32(1), count)
+
+	*now = now.Add(11 * time.Second)
+	c.GetVolume(context.Background(), VolumeRequest{Name: "foo/vol"})
+	assert.Equal(t, int32(2), count)
+}
+
+func TestCacheErrorNotCached(t *testing.T) {
+	var count int32
+	status := int32(http.StatusNotFound)
+	c, _, teardown := testCache(t, &status, &count)
+	defer teardown()
+
+	resp := c.GetPath(context.Background(), VolumeRequest{Name: "foo/vol"})
+	assert.Equal(t, "failed", resp.Err)
+	atomic.StoreInt32(&status, 0)
+	resp = c.GetPath(context.Background(), VolumeRequest{Name: "foo/vol"})
+	assert.Empty(t, resp.Err)
+	assert.Equal(t, "/vol", resp.Mountpoint)
+	assert.Equal(t, int32(2), count)
+}
+
+func TestCacheInvalidate(t *testing.T) {
+	var status, count int32
+	c, _, teardown := testCache(t, &status, &count)
+	defer teardown()
+
+	c.GetVolume(context.Background(), VolumeRequest{Name: "foo/vol"})
+	c.GetVolume(context.Background(), VolumeRequest{Name: "foo/other"})
+	assert.Equal(t, int32(2), count)
+
+	c.RemoveVolume(context.Background(), VolumeRequest{Name: "foo/vol"})
+	count = 0
+	c.GetVolume(context.Background(), VolumeRequest{Name: "foo/vol"})
+	c.GetVolume(context.Background(), VolumeRequest{Name: "foo/other"})
+	assert.Equal(t, int32(1), count)
+}
+
+func TestCacheDefaultRepository(t *testing.T) {
+	var status, count int32
+	c, _, teardown := testCacheWithConfig(t, &status, &count, defaultRepoConfig())
+	defer teardown()
+
+	resp := c.GetVolume(context.Background(), VolumeRequest{Name: "vol"})
+	assert.Equal(t, "vol", resp.Volume.Name)
+	resp = c.GetVolume(context.Background(), VolumeRequest{Name: "foo/vol"})
+	assert.Equal(t, "foo/vol", resp.Volume.Name)
+	assert.Equal(t, int32(1), count)
+
+	c.RemoveVolume(context.Background(), VolumeRequest{Name: "vol"})
+	count = 0
+	c.GetVolume(context.Background(), VolumeRequest{Name: "foo/vol"})
+	assert.Equal(t, int32(1), count)
+}
+
+func TestCacheStale(t *testing.T) {
+	var status, count int32
+	c, now, teardown := testCache(t, &status, &count)
+	defer teardown()
+
+	c.GetVolume(context.Background(), VolumeRequest{Name: "foo/vol"})
+	atomic.StoreInt32(&status, http.StatusServiceUnavailable)
+
+	*now = now.Add(time.Minute)
+	resp := c.GetVolume(context.Background(), VolumeRequest{Name: "foo/vol"})
+	assert.Empty(t, resp.Err)
+	assert.Equal(t, "foo/vol", resp.Volume.Name)
+
+	*now = now.Add(20 * time.Second)
+	resp = c.GetVolume(context.Background(), VolumeRequest{Name: "foo/vol"})
+	assert.Equal(t, "failed", resp.Err)
+}
+
+func TestCacheStaleOnlyWhenUnreachable(t *testing.T) {
+	var status, count int32
+	c, now, teardown := testCache(t, &status, &count)
+	defer teardown()
+
+	c.GetVolume(context.Background(), VolumeRequest{Name: "foo/vol"})
+	atomic.StoreInt32(&status, http.StatusNotFound)
+
+	*now = now.Add(time.Minute)
+	resp := c.GetVolume(context.Background(), VolumeRequest{Name: "foo/vol"})
+	assert.Equal(t, "failed", resp.Err)
+}
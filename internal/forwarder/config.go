@@ -0,0 +1,179 @@
+/*
+ * Copyright The Titan Project Contributors.
+ */
+
+package forwarder
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/titan-data/titan-docker-proxy/internal/logging"
+	"net/http"
+	"time"
+)
+
+/*
+ * A time.Duration that is represented in JSON as a string such as "30s".
+ */
+type Duration time.Duration
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+func (d *Duration) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return fmt.Errorf("duration must be a string such as \"30s\"")
+	}
+	parsed, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = Duration(parsed)
+	return nil
+}
+
+/*
+ * Configuration for the forwarder. Callers should start with DefaultConfig() and override only what they need. The
+ * JSON form is used by the command's configuration file.
+ */
+type Config struct {
+	// titan-server host and port
+	Host string `json:"host"`
+	Port int    `json:"port"`
+
+	// Path of the file used to persist mount state across restarts. If empty, state is only kept in memory.
+	StatePath string `json:"statePath"`
+
+	// What to correct when reconciling mount state with titan-server
+	ReconcilePolicy ReconcilePolicy `json:"reconcilePolicy"`
+
+	// Repository used for volume names that don't specify one. If empty, all names must specify a repository.
+	DefaultRepository string `json:"defaultRepository"`
+
+	// How docker volume names map to titan repositories and volumes
+	Naming NamingConfig `json:"naming"`
+
+	// Whether VolumeDriver.Create should create missing repositories, and the properties to give them. This can be
+	// overridden for an individual volume with the "createRepository" option.
+	AutoCreateRepository bool                   `json:"autoCreateRepository"`
+	RepositoryProperties map[string]interface{} `json:"repositoryProperties"`
+
+	// Which titan metadata to include in the volume status shown by "docker volume inspect"
+	Status StatusConfig `json:"status"`
+
+	// Whether to check that mountpoints exist on this host before returning them from Mount and Path
+	CheckMountpoints bool `json:"checkMountpoints"`
+
+	// Rules for translating mountpoints reported by titan-server into host paths, and the root that all mountpoints
+	// must be within (if any)
+	PathRewrites []PathRewrite `json:"pathRewrites"`
+	MountRoot    string        `json:"mountRoot"`
+
+	// Deadline for each endpoint's calls to titan-server, keyed by endpoint name (such as "VolumeDriver.Mount"). A
+	// zero or missing deadline means only docker's own timeout applies.
+	Timeouts map[string]Duration `json:"timeouts"`
+
+	// How calls to titan-server are retried on transient failures
+	Retry RetryConfig `json:"retry"`
+
+	// When to stop calling an unhealthy titan-server
+	Breaker BreakerConfig `json:"breaker"`
+
+	// How many calls may be made to titan-server at once, and how quickly
+	Limits LimitsConfig `json:"limits"`
+
+	// How volumes are listed across repositories
+	Listing ListingConfig `json:"listing"`
+
+	// How long to wait for other operations on the same volume to finish before giving up. 0 means only the
+	// endpoint's deadline applies.
+	LockTimeout Duration `json:"lockTimeout"`
+
+	// How long volume metadata is cached, if at all
+	Cache CacheConfig `json:"cache"`
+
+	// Decorators to wrap the forwarder in, by name, innermost first. Names can be built-in (such as "cache") or
+	// supplied in DecoratorFactories.
+	Decorators []string `json:"decorators"`
+
+	// Additional decorators that can be named in Decorators, for embedders
+	DecoratorFactories map[string]DecoratorFactory `json:"-"`
+
+	// Custom name resolver, for embedders. If set, overrides DefaultRepository and Naming.
+	NameResolver NameResolver `json:"-"`
+
+	// Where to log to. If nil, informational messages and above are logged to stderr.
+	Logger *logging.Logger `json:"-"`
+
+	// HTTP client used to talk to titan-server, primarily for testing. If nil, the default client is used.
+	HTTPClient *http.Client `json:"-"`
+}
+
+func DefaultConfig() Config {
+	return Config{
+		Host:            "localhost",
+		Port:            5001,
+		ReconcilePolicy: ReconcileReactivate,
+		Naming: NamingConfig{
+			Scheme: NamingSlash,
+		},
+		Status: StatusConfig{
+			Fields:    []string{StatusProperties, StatusActive, StatusEndpoint},
+			Separator: ".",
+		},
+		Timeouts: map[string]Duration{
+			EndpointGet:     Duration(10 * time.Second),
+			EndpointList:    Duration(10 * time.Second),
+			EndpointPath:    Duration(10 * time.Second),
+			EndpointCreate:  Duration(60 * time.Second),
+			EndpointMount:   Duration(30 * time.Second),
+			EndpointRemove:  Duration(30 * time.Second),
+			EndpointUnmount: Duration(30 * time.Second),
+		},
+		Retry: RetryConfig{
+			MaxAttempts:    4,
+			InitialBackoff: Duration(100 * time.Millisecond),
+			MaxBackoff:     Duration(2 * time.Second),
+			Budget:         6,
+		},
+		Listing: ListingConfig{
+			Concurrency:    4,
+			MaxFailedRatio: 0.5,
+		},
+		LockTimeout: Duration(15 * time.Second),
+		Decorators:  []string{DecoratorCache},
+		Breaker: BreakerConfig{
+			FailureThreshold: 5,
+			OpenTimeout:      Duration(10 * time.Second),
+			HalfOpenRequests: 1,
+		},
+		Limits: LimitsConfig{
+			MaxInFlight: 16,
+		},
+	}
+}
+
+func (c Config) timeouts() (map[string]time.Duration, error) {
+	ret := map[string]time.Duration{}
+	for endpoint, timeout := range c.Timeouts {
+		if !isEndpoint(endpoint) {
+			return nil, fmt.Errorf("invalid endpoint '%s' in timeouts", endpoint)
+		}
+		if timeout < 0 {
+			return nil, fmt.Errorf("invalid timeout %s for endpoint '%s'", time.Duration(timeout), endpoint)
+		}
+		ret[endpoint] = time.Duration(timeout)
+	}
+	return ret, nil
+}
+
+func isEndpoint(name string) bool {
+	for _, endpoint := range Endpoints {
+		if endpoint == name {
+			return true
+		}
+	}
+	return false
+}
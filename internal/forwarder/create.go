@@ -0,0 +1,211 @@
+/*
+ * Copyright The Titan Project Contributors.
+ */
+
+package forwarder
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	titan "github.com/titan-data/titan-client-go"
+	"github.com/titan-data/titan-docker-proxy/internal/logging"
+	"net/http"
+	"strconv"
+)
+
+/*
+ * Docker passes "-o key=value" options to VolumeDriver.Create as the Opts map. Most of these become volume properties
+ * in titan, but a few reserved keys instead control how the volume is created, and are stripped before the properties
+ * are sent to titan-server.
+ */
+const (
+	// Create the repository if it doesn't already exist ("true" or "false"), overriding AutoCreateRepository
+	OptCreateRepository = "createRepository"
+	// Populate the volume from the given commit of its repository. Titan can only check out a commit for a repository
+	// as a whole, which would roll back every other volume in it, so this is refused if the repository already has
+	// volumes. Cloning a commit of a repository that is in use isn't supported.
+	OptCommit = "commit"
+	// Repository containing the commit. Titan can only check out commits within a repository, so this must match the
+	// repository of the volume, and exists to guard against creating the volume in the wrong place.
+	OptSourceRepository = "sourceRepository"
+)
+
+var reservedOpts = map[string]bool{
+	OptCreateRepository: true,
+	OptCommit:           true,
+	OptSourceRepository: true,
+}
+
+type createOptions struct {
+	createRepository bool
+	commit           string
+	sourceRepository string
+	properties       map[string]interface{}
+}
+
+func parseStringOpt(opts map[string]interface{}, key string) (string, error) {
+	raw, ok := opts[key]
+	if !ok {
+		return "", nil
+	}
+	if v, ok := raw.(string); ok && v != "" {
+		return v, nil
+	}
+	return "", fmt.Errorf("invalid value '%v' for option '%s'", raw, key)
+}
+
+func parseBoolOpt(opts map[string]interface{}, key string, value bool) (bool, error) {
+	raw, ok := opts[key]
+	if !ok {
+		return value, nil
+	}
+	switch v := raw.(type) {
+	case bool:
+		return v, nil
+	case string:
+		parsed, err := strconv.ParseBool(v)
+		if err == nil {
+			return parsed, nil
+		}
+	}
+	return false, fmt.Errorf("invalid value '%v' for option '%s', must be true or false", raw, key)
+}
+
+func (p forwarder) parseCreateOptions(opts map[string]interface{}) (createOptions, error) {
+	ret := createOptions{
+		properties: map[string]interface{}{},
+	}
+
+	var err error
+	ret.createRepository, err = parseBoolOpt(opts, OptCreateRepository, p.autoCreate)
+	if err == nil {
+		ret.commit, err = parseStringOpt(opts, OptCommit)
+	}
+	if err == nil {
+		ret.sourceRepository, err = parseStringOpt(opts, OptSourceRepository)
+	}
+	if err == nil && ret.sourceRepository != "" && ret.commit == "" {
+		err = fmt.Errorf("option '%s' requires option '%s'", OptSourceRepository, OptCommit)
+	}
+	if err != nil {
+		return ret, err
+	}
+
+	for k, v := range opts {
+		if !reservedOpts[k] {
+			ret.properties[k] = v
+		}
+	}
+	return ret, nil
+}
+
+/*
+ * Checks that the commit we've been asked to populate a volume from exists, before we create anything. Titan has no
+ * way to populate a single volume from a commit, only to check out a commit for a repository as a whole, which would
+ * roll back every other volume in it. So this is only allowed while the repository has no volumes yet. The caller
+ * holds the repository lock, so none can be created through the proxy in the meantime.
+ */
+func (p forwarder) checkSourceCommit(ctx context.Context, repoName string, opts createOptions) error {
+	if opts.sourceRepository != "" && opts.sourceRepository != repoName {
+		return fmt.Errorf("cannot create a volume in repository '%s' from a commit in repository '%s'", repoName,
+			opts.sourceRepository)
+	}
+	commit := opts.commit
+	_, _, err := p.client.GetCommit(ctx, repoName, commit)
+	if err != nil {
+		return err
+	}
+	volumes, _, err := p.client.ListVolumes(ctx, repoName)
+	if err != nil {
+		return err
+	}
+	if len(volumes) != 0 {
+		return fmt.Errorf("cannot populate a volume from commit %s, as repository '%s' already has volumes: titan "+
+			"can only check out a commit for a whole repository, so volumes can only be created from a commit of a "+
+			"repository with none", commit, repoName)
+	}
+	return nil
+}
+
+/*
+ * Populates a newly created volume from a commit by checking it out, which checkSourceCommit() has made sure affects
+ * no other volume. Once the checkout completes, we make sure the volume is ready before telling docker it exists.
+ */
+func (p forwarder) populateVolume(ctx context.Context, repoName string, volumeName string, commit string) error {
+	_, err := p.client.CheckoutCommit(ctx, repoName, commit)
+	if err != nil {
+		return err
+	}
+
+	status, _, err := p.client.GetVolumeStatus(ctx, repoName, volumeName)
+	if err != nil {
+		return err
+	}
+	if status.Error != "" {
+		return errors.New(status.Error)
+	}
+	if !status.Ready {
+		return fmt.Errorf("volume %s/%s is not ready after checking out commit %s", repoName, volumeName, commit)
+	}
+	return nil
+}
+
+/*
+ * Deletes a volume that we created, after it failed to be populated. As with rollbackRepository(), failures are
+ * only logged.
+ */
+func (p forwarder) rollbackVolume(repoName string, volumeName string) {
+	ctx, cancel := p.rollbackContext()
+	defer cancel()
+
+	_, err := p.client.DeleteVolume(ctx, repoName, volumeName)
+	if err != nil {
+		p.log.Error("failed to remove volume after it could not be populated",
+			logging.Volume(mountKey(repoName, volumeName)), errorField(err))
+	}
+}
+
+/*
+ * Creates the given repository if it doesn't already exist, returning whether we created it so that the caller can
+ * roll it back on failure.
+ */
+func (p forwarder) ensureRepository(ctx context.Context, repoName string) (bool, error) {
+	_, resp, err := p.client.GetRepository(ctx, repoName)
+	if err == nil {
+		return false, nil
+	}
+	if resp == nil || resp.StatusCode != http.StatusNotFound {
+		return false, err
+	}
+
+	properties := map[string]interface{}{}
+	for k, v := range p.repoProperties {
+		properties[k] = v
+	}
+	repo := titan.Repository{
+		Name:       repoName,
+		Properties: properties,
+	}
+	_, _, err = p.client.CreateRepository(ctx, repo)
+	if err != nil {
+		return false, err
+	}
+	p.log.Info("created repository", logging.Repository(repoName))
+	return true, nil
+}
+
+/*
+ * Deletes a repository that we created, after the volume within it failed to be created. We're already returning an
+ * error at this point, so a failure to roll back is only logged.
+ */
+func (p forwarder) rollbackRepository(repoName string) {
+	ctx, cancel := p.rollbackContext()
+	defer cancel()
+
+	_, err := p.client.DeleteRepository(ctx, repoName)
+	if err != nil {
+		p.log.Error("failed to remove repository after volume creation failed", logging.Repository(repoName),
+			errorField(err))
+	}
+}
@@ -0,0 +1,239 @@
+/*
+ * Copyright The Titan Project Contributors.
+ */
+
+package forwarder
+
+import (
+	"context"
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"net/http"
+	"testing"
+)
+
+type createServer struct {
+	repoExists    bool
+	volumeFails   bool
+	checkoutFails bool
+	otherVolumes  bool
+	requests      []string
+	bodies        map[string]string
+}
+
+func (s *createServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	body, _ := ioutil.ReadAll(r.Body)
+	request := r.Method + " " + r.RequestURI
+	s.requests = append(s.requests, request)
+	if s.bodies == nil {
+		s.bodies = map[string]string{}
+	}
+	s.bodies[request] = string(body)
+
+	switch request {
+	case "GET /v1/repositories/foo":
+		if s.repoExists {
+			w.Write([]byte("{\"name\":\"foo\",\"properties\":{}}"))
+		} else {
+			w.WriteHeader(http.StatusNotFound)
+			w.Write([]byte("{\"message\":\"no such repository\"}"))
+		}
+	case "POST /v1/repositories":
+		w.WriteHeader(http.StatusCreated)
+		w.Write([]byte("{\"name\":\"foo\",\"properties\":{}}"))
+	case "DELETE /v1/repositories/foo":
+		w.WriteHeader(http.StatusNoContent)
+	case "POST /v1/repositories/foo/volumes":
+		if s.volumeFails {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte("{\"message\":\"bad volume\"}"))
+		} else {
+			w.WriteHeader(http.StatusCreated)
+			w.Write([]byte("{\"name\":\"vol\",\"config\":{},\"properties\":{}}"))
+		}
+	case "GET /v1/repositories/foo/volumes":
+		if s.otherVolumes {
+			w.Write([]byte("[{\"name\":\"other\",\"config\":{},\"properties\":{}}]"))
+		} else {
+			w.Write([]byte("[]"))
+		}
+	case "DELETE /v1/repositories/foo/volumes/vol":
+		w.WriteHeader(http.StatusNoContent)
+	case "GET /v1/repositories/foo/commits/c1":
+		w.Write([]byte("{\"id\":\"c1\",\"properties\":{}}"))
+	case "POST /v1/repositories/foo/commits/c1/checkout":
+		if s.checkoutFails {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte("{\"message\":\"volumes in use\"}"))
+		} else {
+			w.WriteHeader(http.StatusNoContent)
+		}
+	case "GET /v1/repositories/foo/volumes/vol/status":
+		w.Write([]byte("{\"name\":\"vol\",\"logicalSize\":0,\"actualSize\":0,\"properties\":{},\"ready\":true}"))
+	default:
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte("{\"message\":\"unexpected request\"}"))
+	}
+}
+
+func TestCreateVolumeAutoCreateRepository(t *testing.T) {
+	s := &createServer{}
+	config := DefaultConfig()
+	config.AutoCreateRepository = true
+	config.RepositoryProperties = map[string]interface{}{"owner": "docker"}
+	f, teardown := testForwarderWithConfig(s, config)
+	defer teardown()
+
+	resp := f.CreateVolume(context.Background(), CreateVolumeRequest{Name: "foo/vol"})
+	assert.Empty(t, resp.Err)
+	assert.Equal(t, []string{"GET /v1/repositories/foo", "POST /v1/repositories",
+		"POST /v1/repositories/foo/volumes"}, s.requests)
+	assert.Equal(t, "{\"name\":\"foo\",\"properties\":{\"owner\":\"docker\"}}\n", s.bodies["POST /v1/repositories"])
+}
+
+func TestCreateVolumeRepositoryOption(t *testing.T) {
+	s := &createServer{}
+	f, teardown := testForwarderWithConfig(s, DefaultConfig())
+	defer teardown()
+
+	resp := f.CreateVolume(context.Background(), CreateVolumeRequest{Name: "foo/vol",
+		Opts: map[string]interface{}{"createRepository": "true", "a": "b"}})
+	assert.Empty(t, resp.Err)
+	assert.Equal(t, []string{"GET /v1/repositories/foo", "POST /v1/repositories",
+		"POST /v1/repositories/foo/volumes"}, s.requests)
+	assert.Equal(t, "{\"name\":\"vol\",\"properties\":{\"a\":\"b\"}}\n", s.bodies["POST /v1/repositories/foo/volumes"])
+}
+
+func TestCreateVolumeRepositoryOptionDisabled(t *testing.T) {
+	s := &createServer{}
+	config := DefaultConfig()
+	config.AutoCreateRepository = true
+	f, teardown := testForwarderWithConfig(s, config)
+	defer teardown()
+
+	resp := f.CreateVolume(context.Background(), CreateVolumeRequest{Name: "foo/vol",
+		Opts: map[string]interface{}{"createRepository": "false"}})
+	assert.Empty(t, resp.Err)
+	assert.Equal(t, []string{"POST /v1/repositories/foo/volumes"}, s.requests)
+}
+
+func TestCreateVolumeRepositoryExists(t *testing.T) {
+	s := &createServer{repoExists: true}
+	config := DefaultConfig()
+	config.AutoCreateRepository = true
+	f, teardown := testForwarderWithConfig(s, config)
+	defer teardown()
+
+	resp := f.CreateVolume(context.Background(), CreateVolumeRequest{Name: "foo/vol"})
+	assert.Empty(t, resp.Err)
+	assert.Equal(t, []string{"GET /v1/repositories/foo", "POST /v1/repositories/foo/volumes"}, s.requests)
+}
+
+func TestCreateVolumeRepositoryRollback(t *testing.T) {
+	s := &createServer{volumeFails: true}
+	config := DefaultConfig()
+	config.AutoCreateRepository = true
+	f, teardown := testForwarderWithConfig(s, config)
+	defer teardown()
+
+	resp := f.CreateVolume(context.Background(), CreateVolumeRequest{Name: "foo/vol"})
+	assert.Equal(t, "bad volume", resp.Err)
+	assert.Equal(t, []string{"GET /v1/repositories/foo", "POST /v1/repositories",
+		"POST /v1/repositories/foo/volumes", "DELETE /v1/repositories/foo"}, s.requests)
+}
+
+func TestCreateVolumeNoRollbackExistingRepository(t *testing.T) {
+	s := &createServer{repoExists: true, volumeFails: true}
+	config := DefaultConfig()
+	config.AutoCreateRepository = true
+	f, teardown := testForwarderWithConfig(s, config)
+	defer teardown()
+
+	resp := f.CreateVolume(context.Background(), CreateVolumeRequest{Name: "foo/vol"})
+	assert.Equal(t, "bad volume", resp.Err)
+	assert.Equal(t, []string{"GET /v1/repositories/foo", "POST /v1/repositories/foo/volumes"}, s.requests)
+}
+
+func TestCreateVolumeBadRepositoryOption(t *testing.T) {
+	f := New("localhost", 5001)
+
+	resp := f.CreateVolume(context.Background(), CreateVolumeRequest{Name: "foo/vol",
+		Opts: map[string]interface{}{"createRepository": "maybe"}})
+	assert.Equal(t, "invalid value 'maybe' for option 'createRepository', must be true or false", resp.Err)
+}
+
+func TestCreateVolumeFromCommit(t *testing.T) {
+	s := &createServer{}
+	f, teardown := testForwarderWithConfig(s, DefaultConfig())
+	defer teardown()
+
+	resp := f.CreateVolume(context.Background(), CreateVolumeRequest{Name: "foo/vol",
+		Opts: map[string]interface{}{"commit": "c1", "sourceRepository": "foo", "a": "b"}})
+	assert.Empty(t, resp.Err)
+	assert.Equal(t, []string{"GET /v1/repositories/foo/commits/c1", "GET /v1/repositories/foo/volumes",
+		"POST /v1/repositories/foo/volumes",
+		"POST /v1/repositories/foo/commits/c1/checkout", "GET /v1/repositories/foo/volumes/vol/status"}, s.requests)
+	assert.Equal(t, "{\"name\":\"vol\",\"properties\":{\"a\":\"b\"}}\n", s.bodies["POST /v1/repositories/foo/volumes"])
+}
+
+func TestCreateVolumeFromMissingCommit(t *testing.T) {
+	s := &createServer{}
+	f, teardown := testForwarderWithConfig(s, DefaultConfig())
+	defer teardown()
+
+	resp := f.CreateVolume(context.Background(), CreateVolumeRequest{Name: "foo/vol",
+		Opts: map[string]interface{}{"commit": "c2"}})
+	assert.Equal(t, "unexpected request", resp.Err)
+	assert.Equal(t, []string{"GET /v1/repositories/foo/commits/c2"}, s.requests)
+}
+
+func TestCreateVolumeFromCommitCheckoutFailure(t *testing.T) {
+	s := &createServer{checkoutFails: true}
+	config := DefaultConfig()
+	config.AutoCreateRepository = true
+	f, teardown := testForwarderWithConfig(s, config)
+	defer teardown()
+
+	resp := f.CreateVolume(context.Background(), CreateVolumeRequest{Name: "foo/vol",
+		Opts: map[string]interface{}{"commit": "c1"}})
+	assert.Equal(t, "volumes in use", resp.Err)
+	assert.Equal(t, []string{"GET /v1/repositories/foo", "POST /v1/repositories",
+		"GET /v1/repositories/foo/commits/c1", "GET /v1/repositories/foo/volumes", "POST /v1/repositories/foo/volumes",
+		"POST /v1/repositories/foo/commits/c1/checkout", "DELETE /v1/repositories/foo/volumes/vol",
+		"DELETE /v1/repositories/foo"}, s.requests)
+}
+
+func TestCreateVolumeFromCommitWithOtherVolumes(t *testing.T) {
+	s := &createServer{repoExists: true, otherVolumes: true}
+	f, teardown := testForwarderWithConfig(s, DefaultConfig())
+	defer teardown()
+
+	resp := f.CreateVolume(context.Background(), CreateVolumeRequest{Name: "foo/vol",
+		Opts: map[string]interface{}{"commit": "c1"}})
+	assert.Equal(t, "cannot populate a volume from commit c1, as repository 'foo' already has volumes: titan can "+
+		"only check out a commit for a whole repository, so volumes can only be created from a commit of a "+
+		"repository with none", resp.Err)
+	// Nothing is created or checked out, so the other volume is left alone
+	assert.Equal(t, []string{"GET /v1/repositories/foo/commits/c1", "GET /v1/repositories/foo/volumes"},
+		s.requests)
+}
+
+func TestCreateVolumeFromOtherRepository(t *testing.T) {
+	s := &createServer{}
+	f, teardown := testForwarderWithConfig(s, DefaultConfig())
+	defer teardown()
+
+	resp := f.CreateVolume(context.Background(), CreateVolumeRequest{Name: "foo/vol",
+		Opts: map[string]interface{}{"commit": "c1", "sourceRepository": "bar"}})
+	assert.Equal(t, "cannot create a volume in repository 'foo' from a commit in repository 'bar'", resp.Err)
+	assert.Empty(t, s.requests)
+}
+
+func TestCreateVolumeSourceRepositoryWithoutCommit(t *testing.T) {
+	f := New("localhost", 5001)
+
+	resp := f.CreateVolume(context.Background(), CreateVolumeRequest{Name: "foo/vol",
+		Opts: map[string]interface{}{"sourceRepository": "foo"}})
+	assert.Equal(t, "option 'sourceRepository' requires option 'commit'", resp.Err)
+}
@@ -0,0 +1,132 @@
+/*
+ * Copyright The Titan Project Contributors.
+ */
+
+package forwarder
+
+import (
+	"context"
+	"fmt"
+)
+
+/*
+ * Behavior that applies across endpoints, such as caching or auditing, is layered around the titan-backed forwarder
+ * as a stack of decorators rather than being built into it. Decorator delegates every method to the next forwarder
+ * in the stack, so a decorator only needs to embed it and override the methods it cares about. Reconcile, Flush, and
+ * CoalescingStats are passed through as well, so that decorating a forwarder never hides them.
+ *
+ * Which decorators are used, and in what order, comes from the Decorators configuration. Each name refers either to
+ * a built-in decorator or to one supplied by an embedder in DecoratorFactories.
+ */
+type Decorator struct {
+	Next Forwarder
+}
+
+/*
+ * Wraps the next forwarder in a decorator. The configuration is complete, with the logger always set, and a factory
+ * may return the next forwarder unchanged if its decorator isn't enabled.
+ */
+type DecoratorFactory func(next Forwarder, config Config) (Forwarder, error)
+
+const (
+	// Caches volume metadata, if Cache.TTL is set
+	DecoratorCache = "cache"
+)
+
+var builtinDecorators = map[string]DecoratorFactory{
+	DecoratorCache: func(next Forwarder, config Config) (Forwarder, error) {
+		if config.Cache.TTL == 0 {
+			return next, nil
+		}
+		names, err := newNameResolver(config)
+		if err != nil {
+			return nil, err
+		}
+		return newCachingForwarder(next, config.Cache, names, config.Logger), nil
+	},
+}
+
+/*
+ * Wraps the forwarder in each configured decorator in turn, so the first is innermost and the last sees requests
+ * first.
+ */
+func decorate(f Forwarder, config Config) (Forwarder, error) {
+	for _, name := range config.Decorators {
+		factory, ok := config.DecoratorFactories[name]
+		if !ok {
+			factory, ok = builtinDecorators[name]
+		}
+		if !ok {
+			return nil, fmt.Errorf("invalid decorator '%s'", name)
+		}
+		decorated, err := factory(f, config)
+		if err != nil {
+			return nil, fmt.Errorf("unable to create decorator '%s': %w", name, err)
+		}
+		f = decorated
+	}
+	return f, nil
+}
+
+func (d Decorator) CreateVolume(ctx context.Context, request CreateVolumeRequest) VolumeResponse {
+	return d.Next.CreateVolume(ctx, request)
+}
+
+func (d Decorator) GetPath(ctx context.Context, request VolumeRequest) GetPathResponse {
+	return d.Next.GetPath(ctx, request)
+}
+
+func (d Decorator) GetVolume(ctx context.Context, request VolumeRequest) GetVolumeResponse {
+	return d.Next.GetVolume(ctx, request)
+}
+
+func (d Decorator) ListVolumes(ctx context.Context) ListVolumeResponse {
+	return d.Next.ListVolumes(ctx)
+}
+
+func (d Decorator) MountVolume(ctx context.Context, request MountVolumeRequest) GetPathResponse {
+	return d.Next.MountVolume(ctx, request)
+}
+
+func (d Decorator) PluginActivate(ctx context.Context) PluginDescription {
+	return d.Next.PluginActivate(ctx)
+}
+
+func (d Decorator) RemoveVolume(ctx context.Context, request VolumeRequest) VolumeResponse {
+	return d.Next.RemoveVolume(ctx, request)
+}
+
+func (d Decorator) VolumeCapabilities(ctx context.Context) VolumeCapabilities {
+	return d.Next.VolumeCapabilities(ctx)
+}
+
+func (d Decorator) UnmountVolume(ctx context.Context, request MountVolumeRequest) VolumeResponse {
+	return d.Next.UnmountVolume(ctx, request)
+}
+
+/*
+ * Reconciles the next forwarder, if it can be.
+ */
+func (d Decorator) Reconcile(ctx context.Context) error {
+	if reconciler, ok := d.Next.(Reconciler); ok {
+		return reconciler.Reconcile(ctx)
+	}
+	return nil
+}
+
+/*
+ * Flushes the next forwarder's state, if it has any.
+ */
+func (d Decorator) Flush() error {
+	if flusher, ok := d.Next.(Flusher); ok {
+		return flusher.Flush()
+	}
+	return nil
+}
+
+func (d Decorator) CoalescingStats() map[string]CoalescingStats {
+	if coalescer, ok := d.Next.(Coalescer); ok {
+		return coalescer.CoalescingStats()
+	}
+	return map[string]CoalescingStats{}
+}
@@ -0,0 +1,104 @@
+/*
+ * Copyright The Titan Project Contributors.
+ */
+
+package forwarder
+
+import (
+	"context"
+	"errors"
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+/*
+ * Records its name whenever a plugin is activated, and refuses to create volumes.
+ */
+type recordingDecorator struct {
+	Decorator
+	name  string
+	calls *[]string
+}
+
+func (d recordingDecorator) PluginActivate(ctx context.Context) PluginDescription {
+	*d.calls = append(*d.calls, d.name)
+	return d.Next.PluginActivate(ctx)
+}
+
+func (d recordingDecorator) CreateVolume(ctx context.Context, request CreateVolumeRequest) VolumeResponse {
+	return VolumeResponse{Err: d.name + " is read-only"}
+}
+
+func recordingFactory(name string, calls *[]string) DecoratorFactory {
+	return func(next Forwarder, config Config) (Forwarder, error) {
+		return recordingDecorator{Decorator{next}, name, calls}, nil
+	}
+}
+
+func TestDecoratorsStacked(t *testing.T) {
+	calls := []string{}
+	config := DefaultConfig()
+	config.Decorators = []string{"first", "second"}
+	config.DecoratorFactories = map[string]DecoratorFactory{
+		"first":  recordingFactory("first", &calls),
+		"second": recordingFactory("second", &calls),
+	}
+	f, err := NewWithConfig(config)
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	resp := f.PluginActivate(context.Background())
+	assert.Equal(t, "VolumeDriver", resp.Implements[0])
+	assert.Equal(t, []string{"second", "first"}, calls)
+	assert.Equal(t, "second is read-only",
+		f.CreateVolume(context.Background(), CreateVolumeRequest{Name: "foo/vol"}).Err)
+}
+
+func TestDecoratorPassesThrough(t *testing.T) {
+	calls := []string{}
+	config := DefaultConfig()
+	config.Cache.TTL = Duration(10 * time.Second)
+	config.Decorators = []string{DecoratorCache, "outer"}
+	config.DecoratorFactories = map[string]DecoratorFactory{"outer": recordingFactory("outer", &calls)}
+	f, err := NewWithConfig(config)
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	outer := f.(recordingDecorator)
+	_, ok := outer.Next.(*cachingForwarder)
+	assert.True(t, ok)
+	_, ok = f.(Reconciler)
+	assert.True(t, ok)
+	assert.NotNil(t, f.(Coalescer).CoalescingStats())
+}
+
+func TestDecoratorCacheDisabled(t *testing.T) {
+	config := DefaultConfig()
+	config.Decorators = []string{DecoratorCache}
+	f, err := NewWithConfig(config)
+	assert.NoError(t, err)
+	_, ok := f.(forwarder)
+	assert.True(t, ok)
+}
+
+func TestDecoratorInvalid(t *testing.T) {
+	config := DefaultConfig()
+	config.Decorators = []string{"nope"}
+	_, err := NewWithConfig(config)
+	assert.EqualError(t, err, "invalid decorator 'nope'")
+}
+
+func TestDecoratorFactoryFailed(t *testing.T) {
+	config := DefaultConfig()
+	config.Decorators = []string{"broken"}
+	config.DecoratorFactories = map[string]DecoratorFactory{
+		"broken": func(next Forwarder, config Config) (Forwarder, error) {
+			return nil, errors.New("missing audit log")
+		},
+	}
+	_, err := NewWithConfig(config)
+	assert.EqualError(t, err, "unable to create decorator 'broken': missing audit log")
+}
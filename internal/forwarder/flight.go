@@ -0,0 +1,173 @@
+/*
+ * Copyright The Titan Project Contributors.
+ */
+
+package forwarder
+
+import (
+	"context"
+	"sync"
+)
+
+/*
+ * Starting a compose stack makes docker fire off many identical Get, Path, and List requests at once. Rather than
+ * making the same titan-server calls for each of them, identical requests that arrive while one is already in flight
+ * wait for its response instead.
+ *
+ * The shared call doesn't belong to any one docker request, so it runs with its own context, which is only canceled
+ * once every request waiting on it has given up. A request that gives up early gets its own context's error, and the
+ * shared call carries on for the others.
+ *
+ * Stats are kept per key, for up to maxStatsKeys keys. Every volume name looked up has its own keys, so beyond that,
+ * stats are lumped together under OtherStatsKey, which keeps a long-running proxy from growing without bound.
+ */
+type Coalescer interface {
+	CoalescingStats() map[string]CoalescingStats
+}
+
+type CoalescingStats struct {
+	// Number of calls made to titan-server on behalf of the key
+	Calls uint64 `json:"calls"`
+	// Number of requests that shared an in-flight call rather than making their own
+	Coalesced uint64 `json:"coalesced"`
+}
+
+const (
+	maxStatsKeys  = 1000
+	OtherStatsKey = "other"
+)
+
+type flight struct {
+	done    chan struct{}
+	value   interface{}
+	waiters int
+	cancel  context.CancelFunc
+	reach   *reachability
+}
+
+type flightGroup struct {
+	lock    sync.Mutex
+	flights map[string]*flight
+	stats   map[string]*CoalescingStats
+}
+
+func newFlightGroup() *flightGroup {
+	return &flightGroup{
+		flights: map[string]*flight{},
+		stats:   map[string]*CoalescingStats{},
+	}
+}
+
+/*
+ * Identifies a request by its endpoint and volume name, if any.
+ */
+func requestKey(endpoint string, name string) string {
+	if name == "" {
+		return endpoint
+	}
+	return endpoint + ":" + name
+}
+
+/*
+ * Returns the result of fn, either from a call already in flight for the key or by starting a new one. The only
+ * error returned is that of the given context, if it's done before the result is available.
+ */
+func (g *flightGroup) do(ctx context.Context, key string, fn func(ctx context.Context) interface{}) (interface{},
+	error) {
+	g.lock.Lock()
+	stats := g.keyStats(key)
+	f, ok := g.flights[key]
+	if ok {
+		f.waiters++
+		stats.Coalesced++
+	} else {
+		stats.Calls++
+		f = g.start(key, fn)
+	}
+	g.lock.Unlock()
+
+	select {
+	case <-f.done:
+		// Let the cache know if the shared call found titan-server unreachable
+		if f.reach.failed() {
+			markUnreachable(ctx)
+		}
+		return f.value, nil
+	case <-ctx.Done():
+		g.lock.Lock()
+		f.waiters--
+		if f.waiters == 0 {
+			f.cancel()
+			g.forget(key, f)
+		}
+		g.lock.Unlock()
+		return nil, ctx.Err()
+	}
+}
+
+/*
+ * Returns the stats to count a call for the key against. Must be called with the lock held.
+ */
+func (g *flightGroup) keyStats(key string) *CoalescingStats {
+	if stats, ok := g.stats[key]; ok {
+		return stats
+	}
+	if len(g.stats) >= maxStatsKeys {
+		key = OtherStatsKey
+		if stats, ok := g.stats[key]; ok {
+			return stats
+		}
+	}
+	stats := &CoalescingStats{}
+	g.stats[key] = stats
+	return stats
+}
+
+/*
+ * Starts a new shared call for the key. Must be called with the lock held.
+ */
+func (g *flightGroup) start(key string, fn func(ctx context.Context) interface{}) *flight {
+	ctx, cancel := context.WithCancel(context.Background())
+	ctx, reach := withReachability(ctx)
+	f := &flight{
+		done:    make(chan struct{}),
+		waiters: 1,
+		cancel:  cancel,
+		reach:   reach,
+	}
+	g.flights[key] = f
+
+	go func() {
+		f.value = fn(ctx)
+		g.lock.Lock()
+		g.forget(key, f)
+		g.lock.Unlock()
+		cancel()
+		close(f.done)
+	}()
+	return f
+}
+
+/*
+ * Stops new requests from joining the given call. Must be called with the lock held.
+ */
+func (g *flightGroup) forget(key string, f *flight) {
+	if g.flights[key] == f {
+		delete(g.flights, key)
+	}
+}
+
+func (g *flightGroup) snapshot() map[string]CoalescingStats {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+
+	ret := map[string]CoalescingStats{}
+	for key, stats := range g.stats {
+		ret[key] = *stats
+	}
+	return ret
+}
+
+func (p forwarder) CoalescingStats() map[string]CoalescingStats {
+	return p.flights.snapshot()
+}
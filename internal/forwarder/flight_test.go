@@ -0,0 +1,145 @@
+/*
+ * Copyright The Titan Project Contributors.
+ */
+
+package forwarder
+
+import (
+	"context"
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+/*
+ * Serves a volume once released, counting requests.
+ */
+func blockingHandler(release chan struct{}, count *int32) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(count, 1)
+		select {
+		case <-release:
+		case <-r.Context().Done():
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte("{\"name\":\"vol\",\"config\":{\"mountpoint\":\"/vol\"},\"properties\":{}}"))
+	})
+}
+
+/*
+ * Waits until the given number of requests are waiting on a call for the key.
+ */
+func waitForWaiters(t *testing.T, f forwarder, key string, waiters int) {
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		f.flights.lock.Lock()
+		flight, ok := f.flights.flights[key]
+		ready := ok && flight.waiters == waiters
+		f.flights.lock.Unlock()
+		if ready {
+			return
+		}
+		time.Sleep(time.Millisecond)
+	}
+	t.Errorf("timed out waiting for %d waiters on %s", waiters, key)
+}
+
+func TestCoalesceGet(t *testing.T) {
+	var count int32
+	release := make(chan struct{})
+	f, teardown := testForwarderWithConfig(blockingHandler(release, &count), DefaultConfig())
+	defer teardown()
+
+	var wg sync.WaitGroup
+	responses := make([]GetVolumeResponse, 5)
+	for i := range responses {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			responses[i] = f.GetVolume(context.Background(), VolumeRequest{Name: "foo/vol"})
+		}(i)
+	}
+	waitForWaiters(t, f.(forwarder), "VolumeDriver.Get:foo/vol", 5)
+	close(release)
+	wg.Wait()
+
+	for _, resp := range responses {
+		assert.Empty(t, resp.Err)
+		assert.Equal(t, "foo/vol", resp.Volume.Name)
+	}
+	assert.Equal(t, int32(1), count)
+	stats := f.(Coalescer).CoalescingStats()
+	assert.Equal(t, CoalescingStats{Calls: 1, Coalesced: 4}, stats["VolumeDriver.Get:foo/vol"])
+
+	f.GetPath(context.Background(), VolumeRequest{Name: "foo/vol"})
+	assert.Equal(t, int32(2), count)
+	stats = f.(Coalescer).CoalescingStats()
+	assert.Equal(t, CoalescingStats{Calls: 1}, stats["VolumeDriver.Path:foo/vol"])
+}
+
+func TestCoalesceWaiterCanceled(t *testing.T) {
+	var count int32
+	release := make(chan struct{})
+	f, teardown := testForwarderWithConfig(blockingHandler(release, &count), DefaultConfig())
+	defer teardown()
+
+	var resp GetPathResponse
+	done := make(chan struct{})
+	go func() {
+		resp = f.GetPath(context.Background(), VolumeRequest{Name: "foo/vol"})
+		close(done)
+	}()
+	waitForWaiters(t, f.(forwarder), "VolumeDriver.Path:foo/vol", 1)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		waitForWaiters(t, f.(forwarder), "VolumeDriver.Path:foo/vol", 2)
+		cancel()
+	}()
+	canceled := f.GetPath(ctx, VolumeRequest{Name: "foo/vol"})
+	assert.Equal(t, CanceledError, canceled.Err)
+
+	close(release)
+	<-done
+	assert.Empty(t, resp.Err)
+	assert.Equal(t, "/vol", resp.Mountpoint)
+	assert.Equal(t, int32(1), count)
+}
+
+func TestCoalesceAllCanceled(t *testing.T) {
+	var count int32
+	release := make(chan struct{})
+	defer close(release)
+	f, teardown := testForwarderWithConfig(blockingHandler(release, &count), DefaultConfig())
+	defer teardown()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		waitForWaiters(t, f.(forwarder), "VolumeDriver.List", 1)
+		cancel()
+	}()
+	resp := f.ListVolumes(ctx)
+	assert.Equal(t, CanceledError, resp.Err)
+
+	f.(forwarder).flights.lock.Lock()
+	assert.Empty(t, f.(forwarder).flights.flights)
+	f.(forwarder).flights.lock.Unlock()
+}
+
+func TestCoalesceStatsBounded(t *testing.T) {
+	g := newFlightGroup()
+	for i := 0; i < maxStatsKeys+10; i++ {
+		g.do(context.Background(), requestKey(EndpointGet, fmt.Sprintf("foo/vol%d", i)),
+			func(ctx context.Context) interface{} { return nil })
+	}
+
+	stats := g.snapshot()
+	assert.Len(t, stats, maxStatsKeys+1)
+	assert.Equal(t, CoalescingStats{Calls: 1}, stats["VolumeDriver.Get:foo/vol0"])
+	assert.Equal(t, CoalescingStats{Calls: 10}, stats[OtherStatsKey])
+}
@@ -9,8 +9,9 @@ import (
 	"errors"
 	"fmt"
 	titan "github.com/titan-data/titan-client-go"
+	"github.com/titan-data/titan-docker-proxy/internal/logging"
 	"net/http"
-	"regexp"
+	"time"
 )
 
 /*
@@ -18,30 +19,98 @@ import (
  * instance of titan-server. The inputs to these functions are all structures defined in this package. The
  * responsibility of listening on the appropriate docker socket, marshalling to and from JSON, etc rests with
  * other portions of the package.
+ *
+ * Every method takes the context of the docker request, so that calls to titan-server are abandoned if docker gives
+ * up on the request, in addition to the per-endpoint deadlines applied by the forwarder itself.
  */
 
 type Forwarder interface {
-	CreateVolume(request CreateVolumeRequest) VolumeResponse
-	GetPath(request VolumeRequest) GetPathResponse
-	GetVolume(request VolumeRequest) GetVolumeResponse
-	ListVolumes() ListVolumeResponse
-	MountVolume(request MountVolumeRequest) GetPathResponse
-	PluginActivate() PluginDescription
-	RemoveVolume(request VolumeRequest) VolumeResponse
-	VolumeCapabilities() VolumeCapabilities
-	UnmountVolume(request MountVolumeRequest) VolumeResponse
+	CreateVolume(ctx context.Context, request CreateVolumeRequest) VolumeResponse
+	GetPath(ctx context.Context, request VolumeRequest) GetPathResponse
+	GetVolume(ctx context.Context, request VolumeRequest) GetVolumeResponse
+	ListVolumes(ctx context.Context) ListVolumeResponse
+	MountVolume(ctx context.Context, request MountVolumeRequest) GetPathResponse
+	PluginActivate(ctx context.Context) PluginDescription
+	RemoveVolume(ctx context.Context, request VolumeRequest) VolumeResponse
+	VolumeCapabilities(ctx context.Context) VolumeCapabilities
+	UnmountVolume(ctx context.Context, request MountVolumeRequest) VolumeResponse
+}
+
+/*
+ * Names of the docker plugin API endpoints, each of which corresponds to one Forwarder method. The listener serves
+ * each one at "/<name>", and they are used to key per-endpoint configuration.
+ */
+const (
+	EndpointPluginActivate = "Plugin.Activate"
+	EndpointCapabilities   = "VolumeDriver.Capabilities"
+	EndpointCreate         = "VolumeDriver.Create"
+	EndpointGet            = "VolumeDriver.Get"
+	EndpointList           = "VolumeDriver.List"
+	EndpointMount          = "VolumeDriver.Mount"
+	EndpointPath           = "VolumeDriver.Path"
+	EndpointRemove         = "VolumeDriver.Remove"
+	EndpointUnmount        = "VolumeDriver.Unmount"
+)
+
+var Endpoints = []string{
+	EndpointPluginActivate,
+	EndpointCapabilities,
+	EndpointCreate,
+	EndpointGet,
+	EndpointList,
+	EndpointMount,
+	EndpointPath,
+	EndpointRemove,
+	EndpointUnmount,
 }
 
 type forwarder struct {
-	client *titan.APIClient
-	ctx    context.Context
+	client   *titanClient
+	timeouts map[string]time.Duration
+	budget   int
+	mounts   *mountTable
+	policy   ReconcilePolicy
+	names    NameResolver
+
+	listing      ListingConfig
+	listFailures *uint64
+
+	flights *flightGroup
+	locks   *volumeLocks
+
+	log *logging.Logger
+
+	autoCreate     bool
+	repoProperties map[string]interface{}
+
+	endpoint        string
+	statusFields    map[string]bool
+	statusSeparator string
+
+	checkMountpoints bool
+	paths            pathRewriter
 }
 
+/*
+ * Returned when titan-server doesn't respond within the endpoint's deadline, or docker abandons the request.
+ */
+const (
+	TimeoutError  = "timed out waiting for titan-server"
+	CanceledError = "request canceled"
+)
+
 /*
  * Converts an error object into an "Err" string to return to consumers. If this is a titan-server API error, then
- * we return the message field. Otherwise, we return the default error string.
+ * we return the message field. Timeouts and cancellation are reported with fixed messages so that they can be
+ * distinguished from errors reported by titan-server. Otherwise, we return the default error string.
  */
 func getErrorString(err error) string {
+	if errors.Is(err, context.DeadlineExceeded) {
+		return TimeoutError
+	}
+	if errors.Is(err, context.Canceled) {
+		return CanceledError
+	}
 	if openApiErr, ok := err.(titan.GenericOpenAPIError); ok {
 		if apiErr, ok := openApiErr.Model().(titan.ApiError); ok {
 			return apiErr.Message
@@ -51,15 +120,10 @@ func getErrorString(err error) string {
 }
 
 /*
- * Converts a docker volume name (repo/vol) to a (repo, volume) tuple for use with the titan API.
+ * Logs an error the same way it would be reported to docker.
  */
-func parseVolumeName(volumeName string) (string, string, error) {
-	re := regexp.MustCompile(`^([^/]+)/([^/]+)$`)
-	match := re.FindStringSubmatch(volumeName)
-	if len(match) != 3 {
-		return "", "", errors.New("volume name must be of the form <repository>/<volume>")
-	}
-	return match[1], match[2], nil
+func errorField(err error) logging.Field {
+	return logging.F("error", getErrorString(err))
 }
 
 /*
@@ -75,14 +139,19 @@ func standardResponse(err error) VolumeResponse {
 
 /*
  * Converts from a Titan volume to a Docker volume. The main difference is that the repository name is part of the
- * volume name. The mountpoint is also pulled out of the properties to a first class response.
+ * volume name. The mountpoint is also pulled out of the properties to a first class response, and the status is
+ * filled in from the volume and the (pre-fetched) repository status.
  */
-func convertVolume(repo string, vol titan.Volume) Volume {
-	return Volume{
-		Name:       fmt.Sprintf("%s/%s", repo, vol.Name),
-		Mountpoint: vol.Config["mountpoint"].(string),
-		Status:     map[string]string{},
+func (p forwarder) convertVolume(repo string, vol titan.Volume, repoStatus map[string]string) (Volume, error) {
+	mountpoint, err := p.getMountpoint(repo, vol)
+	if err != nil {
+		return Volume{}, err
 	}
+	return Volume{
+		Name:       p.names.Format(repo, vol.Name),
+		Mountpoint: mountpoint,
+		Status:     p.volumeStatus(repo, vol, repoStatus),
+	}, nil
 }
 
 /*
@@ -90,37 +159,41 @@ func convertVolume(repo string, vol titan.Volume) Volume {
  *
  * This always returns a static definition with a "local" scope.
  */
-func (p forwarder) VolumeCapabilities() VolumeCapabilities {
+func (p forwarder) VolumeCapabilities(ctx context.Context) VolumeCapabilities {
 	return VolumeCapabilities{Capabilities: Capability{Scope: "local"}}
 }
 
 /*
  * /VolumeDriver.List
  *
- * Returns a list of all volumes on the system. This requires iterating over all repositories followed by the volumes
- * for each.
+ * Returns a list of all volumes on the system. This requires listing all repositories followed by the volumes for
+ * each, which is done concurrently. Volumes with an invalid mountpoint are still listed, but without one. Concurrent
+ * listings share a single set of calls.
  */
-func (p forwarder) ListVolumes() ListVolumeResponse {
-	repositories, _, err := p.client.RepositoriesApi.ListRepositories(p.ctx)
+func (p forwarder) ListVolumes(ctx context.Context) ListVolumeResponse {
+	resp, err := p.flights.do(ctx, requestKey(EndpointList, ""), func(ctx context.Context) interface{} {
+		return p.listVolumes(ctx)
+	})
 	if err != nil {
 		return ListVolumeResponse{Err: getErrorString(err)}
 	}
+	return resp.(ListVolumeResponse)
+}
 
-	ret := ListVolumeResponse{
-		Volumes: []Volume{},
-	}
+func (p forwarder) listVolumes(ctx context.Context) ListVolumeResponse {
+	ctx, cancel := p.begin(ctx, EndpointList)
+	defer cancel()
 
-	for _, repo := range repositories {
-		volumes, _, err := p.client.VolumesApi.ListVolumes(p.ctx, repo.Name)
-		if err != nil {
-			return ListVolumeResponse{Err: getErrorString(err)}
-		}
-		for _, vol := range volumes {
-			ret.Volumes = append(ret.Volumes, convertVolume(repo.Name, vol))
-		}
+	repositories, _, err := p.client.ListRepositories(ctx)
+	if err != nil {
+		return ListVolumeResponse{Err: getErrorString(err)}
 	}
 
-	return ret
+	volumes, err := p.listRepositories(ctx, repositories)
+	if err != nil {
+		return ListVolumeResponse{Err: getErrorString(err)}
+	}
+	return ListVolumeResponse{Volumes: volumes}
 }
 
 /*
@@ -128,7 +201,7 @@ func (p forwarder) ListVolumes() ListVolumeResponse {
  *
  * This always returns a static definition implementing "VolumeDriver"
  */
-func (p forwarder) PluginActivate() PluginDescription {
+func (p forwarder) PluginActivate(ctx context.Context) PluginDescription {
 	return PluginDescription{
 		Implements: []string{"VolumeDriver"},
 	}
@@ -137,52 +210,147 @@ func (p forwarder) PluginActivate() PluginDescription {
 /*
  * /VolumeDriver.Get
  *
- * Get a single volume.
+ * Get a single volume. Concurrent requests for the same volume share a single set of calls, even if they use
+ * different names for it, but each is answered with the name it asked for, as docker records the volume under the
+ * name it gets back.
  */
-func (p forwarder) GetVolume(request VolumeRequest) GetVolumeResponse {
-	repoName, volumeName, err := parseVolumeName(request.Name)
+func (p forwarder) GetVolume(ctx context.Context, request VolumeRequest) GetVolumeResponse {
+	key := requestKey(EndpointGet, canonicalName(p.names, request.Name))
+	resp, err := p.flights.do(ctx, key, func(ctx context.Context) interface{} {
+		return p.getVolume(ctx, request)
+	})
 	if err != nil {
 		return GetVolumeResponse{Err: getErrorString(err)}
 	}
+	return withRequestName(resp.(GetVolumeResponse), request.Name)
+}
+
+func withRequestName(resp GetVolumeResponse, name string) GetVolumeResponse {
+	if resp.Err == "" {
+		resp.Volume.Name = name
+	}
+	return resp
+}
+
+func (p forwarder) getVolume(ctx context.Context, request VolumeRequest) GetVolumeResponse {
+	ctx, cancel := p.begin(ctx, EndpointGet)
+	defer cancel()
 
-	volume, _, err := p.client.VolumesApi.GetVolume(p.ctx, repoName, volumeName)
+	repoName, volumeName, err := p.names.Parse(request.Name)
 	if err != nil {
 		return GetVolumeResponse{Err: getErrorString(err)}
 	}
 
-	return GetVolumeResponse{Volume: convertVolume(repoName, volume)}
+	volume, _, err := p.client.GetVolume(ctx, repoName, volumeName)
+	if err != nil {
+		return GetVolumeResponse{Err: getErrorString(err)}
+	}
+
+	converted, err := p.convertVolume(repoName, volume, p.repositoryStatus(ctx, repoName))
+	if err != nil {
+		return GetVolumeResponse{Err: getErrorString(err)}
+	}
+	return GetVolumeResponse{Volume: converted}
 }
 
 /*
  * /VolumeDriver.Path
  *
- * Get the mountpoint for a volume. Equivalent to getting the mountpoint member of the volume.
+ * Get the mountpoint for a volume. Equivalent to getting the mountpoint member of the volume, though we skip
+ * building the volume status, as docker has no use for it here. Concurrent requests for the same volume share a
+ * single call, whatever name they use for it.
  */
-func (p forwarder) GetPath(request VolumeRequest) GetPathResponse {
-	vol := p.GetVolume(request)
-	if vol.Err != "" {
-		return GetPathResponse{Err: vol.Err}
+func (p forwarder) GetPath(ctx context.Context, request VolumeRequest) GetPathResponse {
+	key := requestKey(EndpointPath, canonicalName(p.names, request.Name))
+	resp, err := p.flights.do(ctx, key, func(ctx context.Context) interface{} {
+		return p.getPath(ctx, request)
+	})
+	if err != nil {
+		return GetPathResponse{Err: getErrorString(err)}
+	}
+	return resp.(GetPathResponse)
+}
+
+func (p forwarder) getPath(ctx context.Context, request VolumeRequest) GetPathResponse {
+	ctx, cancel := p.begin(ctx, EndpointPath)
+	defer cancel()
+
+	repoName, volumeName, err := p.names.Parse(request.Name)
+	if err != nil {
+		return GetPathResponse{Err: getErrorString(err)}
+	}
+
+	volume, _, err := p.client.GetVolume(ctx, repoName, volumeName)
+	if err != nil {
+		return GetPathResponse{Err: getErrorString(err)}
 	}
-	return GetPathResponse{Mountpoint: vol.Volume.Mountpoint}
+
+	mountpoint, err := p.getMountpoint(repoName, volume)
+	if err == nil {
+		err = p.checkMountpoint(repoName, volumeName, mountpoint)
+	}
+	if err != nil {
+		return GetPathResponse{Err: getErrorString(err)}
+	}
+	return GetPathResponse{Mountpoint: mountpoint}
 }
 
 /*
  * /VolumeDriver.Create
  *
- * Create a new repository. The "Opts" map is converted to be the volume properties.
+ * Create a new volume. The "Opts" map is converted to be the volume properties, less any reserved options. If
+ * requested, the repository is created first, and the volume is populated from a commit once created. If any step
+ * fails, whatever we created along the way is removed again.
  */
-func (p forwarder) CreateVolume(request CreateVolumeRequest) VolumeResponse {
-	repoName, volumeName, err := parseVolumeName(request.Name)
-	if err == nil {
-		properties := map[string]interface{}{}
-		if request.Opts != nil {
-			properties = request.Opts
+func (p forwarder) CreateVolume(ctx context.Context, request CreateVolumeRequest) VolumeResponse {
+	ctx, cancel := p.begin(ctx, EndpointCreate)
+	defer cancel()
+
+	repoName, volumeName, err := p.names.Parse(request.Name)
+	if err != nil {
+		return standardResponse(err)
+	}
+
+	opts, err := p.parseCreateOptions(request.Opts)
+	if err != nil {
+		return standardResponse(err)
+	}
+
+	// Rolling back a repository we created must not take another volume created in the meantime with it
+	unlock, err := p.locks.acquire(ctx, repositoryLockKey(repoName), volumeLockKey(repoName, volumeName))
+	if err != nil {
+		return standardResponse(err)
+	}
+	defer unlock()
+
+	createdRepo := false
+	if opts.createRepository {
+		createdRepo, err = p.ensureRepository(ctx, repoName)
+		if err != nil {
+			return standardResponse(err)
 		}
+	}
+
+	if opts.commit != "" {
+		err = p.checkSourceCommit(ctx, repoName, opts)
+	}
+
+	if err == nil {
 		vol := titan.Volume{
 			Name:       volumeName,
-			Properties: properties,
+			Properties: opts.properties,
 		}
-		_, _, err = p.client.VolumesApi.CreateVolume(p.ctx, repoName, vol)
+		_, _, err = p.client.CreateVolume(ctx, repoName, vol)
+		if err == nil && opts.commit != "" {
+			err = p.populateVolume(ctx, repoName, volumeName, opts.commit)
+			if err != nil {
+				p.rollbackVolume(repoName, volumeName)
+			}
+		}
+	}
+
+	if err != nil && createdRepo {
+		p.rollbackRepository(repoName)
 	}
 	return standardResponse(err)
 }
@@ -192,61 +360,150 @@ func (p forwarder) CreateVolume(request CreateVolumeRequest) VolumeResponse {
  *
  * Delete a volume. This simply parses the name to the native titan form, and marshals any errors in the process.
  */
-func (p forwarder) RemoveVolume(request VolumeRequest) VolumeResponse {
-	repoName, volumeName, err := parseVolumeName(request.Name)
+func (p forwarder) RemoveVolume(ctx context.Context, request VolumeRequest) VolumeResponse {
+	ctx, cancel := p.begin(ctx, EndpointRemove)
+	defer cancel()
+
+	repoName, volumeName, err := p.names.Parse(request.Name)
 	if err != nil {
 		return standardResponse(err)
 	}
 
-	_, err = p.client.VolumesApi.DeleteVolume(p.ctx, repoName, volumeName)
+	unlock, err := p.locks.acquire(ctx, volumeLockKey(repoName, volumeName))
+	if err != nil {
+		return standardResponse(err)
+	}
+	defer unlock()
+
+	_, err = p.client.DeleteVolume(ctx, repoName, volumeName)
+	if err == nil {
+		p.mounts.remove(repoName, volumeName)
+	}
 	return standardResponse(err)
 }
 
 /*
  * /VolumeDriver.Mount
  *
- * Mount a volume. This is equivalent to activating a titan volume.
+ * Mount a volume. This is equivalent to activating a titan volume, though we only activate the volume for the first
+ * mount ID that references it. If the mountpoint turns out to be unusable once mounted, the mount is undone.
  */
-func (p forwarder) MountVolume(request MountVolumeRequest) GetPathResponse {
-	repoName, volumeName, err := parseVolumeName(request.Name)
-	if err == nil {
-		var vol titan.Volume
-		vol, _, err = p.client.VolumesApi.GetVolume(p.ctx, repoName, volumeName)
-		if err == nil {
-			_, err = p.client.VolumesApi.ActivateVolume(p.ctx, repoName, volumeName)
+func (p forwarder) MountVolume(ctx context.Context, request MountVolumeRequest) GetPathResponse {
+	ctx, cancel := p.begin(ctx, EndpointMount)
+	defer cancel()
+
+	repoName, volumeName, err := p.names.Parse(request.Name)
+	if err != nil {
+		return GetPathResponse{Err: getErrorString(err)}
+	}
+
+	unlock, err := p.locks.acquire(ctx, volumeLockKey(repoName, volumeName))
+	if err != nil {
+		return GetPathResponse{Err: getErrorString(err)}
+	}
+	defer unlock()
+
+	vol, _, err := p.client.GetVolume(ctx, repoName, volumeName)
+	if err != nil {
+		return GetPathResponse{Err: getErrorString(err)}
+	}
+
+	mountpoint, err := p.getMountpoint(repoName, vol)
+	if err != nil {
+		return GetPathResponse{Err: getErrorString(err)}
+	}
+
+	added, err := p.mounts.mount(repoName, volumeName, request.ID, p.activate(ctx, repoName, volumeName))
+	if err != nil {
+		return GetPathResponse{Err: getErrorString(err)}
+	}
+
+	err = p.checkMountpoint(repoName, volumeName, mountpoint)
+	if err != nil {
+		// An ID recorded by an earlier mount still has the volume in use, so only roll back what we added
+		if !added {
+			return GetPathResponse{Err: getErrorString(err)}
 		}
-		if err == nil {
-			return GetPathResponse{Mountpoint: vol.Config["mountpoint"].(string)}
+		unmountErr := p.mounts.unmount(repoName, volumeName, request.ID, p.deactivate(ctx, repoName, volumeName))
+		if unmountErr != nil {
+			p.log.Error("failed to unmount volume after mountpoint check failed",
+				logging.Volume(mountKey(repoName, volumeName)), logging.MountID(request.ID), errorField(unmountErr))
 		}
+		return GetPathResponse{Err: getErrorString(err)}
 	}
 
-	return GetPathResponse{Err: getErrorString(err)}
+	return GetPathResponse{Mountpoint: mountpoint}
 }
 
 /*
  * /VolumeDriver.Unmount
  *
- * Unmount a volume. This is equivalent to deactivating a titan volume.
+ * Unmount a volume. This is equivalent to deactivating a titan volume, though we only deactivate the volume once the
+ * last mount ID that references it has been unmounted.
  */
-func (p forwarder) UnmountVolume(request MountVolumeRequest) VolumeResponse {
-	repoName, volumeName, err := parseVolumeName(request.Name)
-	if err == nil {
-		_, err = p.client.VolumesApi.DeactivateVolume(p.ctx, repoName, volumeName)
+func (p forwarder) UnmountVolume(ctx context.Context, request MountVolumeRequest) VolumeResponse {
+	ctx, cancel := p.begin(ctx, EndpointUnmount)
+	defer cancel()
+
+	repoName, volumeName, err := p.names.Parse(request.Name)
+	if err != nil {
+		return standardResponse(err)
+	}
+
+	unlock, err := p.locks.acquire(ctx, volumeLockKey(repoName, volumeName))
+	if err != nil {
+		return standardResponse(err)
+	}
+	defer unlock()
+
+	return standardResponse(p.mounts.unmount(repoName, volumeName, request.ID, p.deactivate(ctx, repoName,
+		volumeName)))
+}
+
+func (p forwarder) activate(ctx context.Context, repoName string, volumeName string) func() error {
+	return func() error {
+		_, err := p.client.ActivateVolume(ctx, repoName, volumeName)
+		return err
+	}
+}
+
+func (p forwarder) deactivate(ctx context.Context, repoName string, volumeName string) func() error {
+	return func() error {
+		_, err := p.client.DeactivateVolume(ctx, repoName, volumeName)
+		return err
 	}
-	return standardResponse(err)
 }
 
 /*
- * Public forwarder constructor. Takes a host ("localhost") and port (5001) to pass to the client.
+ * Prepares the context for handling a docker request, applying the retry budget and the deadline configured for the
+ * endpoint, and recording the endpoint for the limiter.
  */
-func New(host string, port int) Forwarder {
-	config := titan.NewConfiguration()
-	config.Host = fmt.Sprintf("%s:%d", host, port)
-	client := titan.NewAPIClient(config)
-	return forwarder{
-		client: client,
-		ctx:    context.Background(),
+func (p forwarder) begin(ctx context.Context, endpoint string) (context.Context, context.CancelFunc) {
+	ctx = withEndpoint(withRetryBudget(ctx, p.budget), endpoint)
+	if timeout := p.timeouts[endpoint]; timeout > 0 {
+		return context.WithTimeout(ctx, timeout)
 	}
+	return context.WithCancel(ctx)
+}
+
+/*
+ * Rolling back after a failure needs to happen even if the failure was the request timing out, so rollbacks get a
+ * fresh context bounded by the Remove deadline.
+ */
+func (p forwarder) rollbackContext() (context.Context, context.CancelFunc) {
+	return p.begin(context.Background(), EndpointRemove)
+}
+
+/*
+ * Public forwarder constructor. Takes a host ("localhost") and port (5001) to pass to the client. Because no state
+ * file is used, this cannot fail.
+ */
+func New(host string, port int) Forwarder {
+	config := DefaultConfig()
+	config.Host = host
+	config.Port = port
+	f, _ := create(config)
+	return f
 }
 
 /*
@@ -254,11 +511,107 @@ func New(host string, port int) Forwarder {
  * testing.
  */
 func NewClient(httpClient *http.Client) Forwarder {
-	config := titan.NewConfiguration()
+	config := DefaultConfig()
 	config.HTTPClient = httpClient
-	client := titan.NewAPIClient(config)
-	return forwarder{
-		client: client,
-		ctx:    context.Background(),
+	f, _ := create(config)
+	return f
+}
+
+/*
+ * Creates a forwarder from a complete configuration, wrapped in the configured decorators. This will fail if the
+ * persisted mount state cannot be loaded.
+ */
+func NewWithConfig(config Config) (Forwarder, error) {
+	f, err := create(config)
+	if err != nil {
+		return nil, err
+	}
+	config.Logger = f.log
+	return decorate(f, config)
+}
+
+func create(config Config) (forwarder, error) {
+	if err := config.ReconcilePolicy.validate(); err != nil {
+		return forwarder{}, err
+	}
+	names, err := newNameResolver(config)
+	if err != nil {
+		return forwarder{}, err
+	}
+	statusFields, err := config.Status.fieldSet()
+	if err != nil {
+		return forwarder{}, err
+	}
+	paths, err := newPathRewriter(config.PathRewrites, config.MountRoot)
+	if err != nil {
+		return forwarder{}, err
+	}
+	timeouts, err := config.timeouts()
+	if err != nil {
+		return forwarder{}, err
+	}
+	if err = config.Retry.validate(); err != nil {
+		return forwarder{}, err
+	}
+	if err = config.Breaker.validate(); err != nil {
+		return forwarder{}, err
+	}
+	if err = config.Listing.validate(); err != nil {
+		return forwarder{}, err
+	}
+	if err = config.Cache.validate(); err != nil {
+		return forwarder{}, err
+	}
+	if err = config.Limits.validate(); err != nil {
+		return forwarder{}, err
+	}
+	if config.LockTimeout < 0 {
+		return forwarder{}, errors.New("lock timeout cannot be negative")
+	}
+
+	titanConfig := titan.NewConfiguration()
+	endpoint := fmt.Sprintf("%s:%d", config.Host, config.Port)
+	titanConfig.Host = endpoint
+	if config.HTTPClient != nil {
+		titanConfig.HTTPClient = config.HTTPClient
+	}
+
+	var store *stateStore
+	if config.StatePath != "" {
+		store = newStateStore(config.StatePath)
 	}
+	log := config.Logger
+	if log == nil {
+		log = logging.Default()
+	}
+	mounts, err := newMountTable(store, log)
+	if err != nil {
+		return forwarder{}, err
+	}
+
+	return forwarder{
+		client:   newTitanClient(titanConfig, config.Retry, config.Breaker, config.Limits, log),
+		log:      log,
+		timeouts: timeouts,
+		budget:   config.Retry.Budget,
+		mounts:   mounts,
+		policy:   config.ReconcilePolicy,
+		names:    names,
+
+		listing:      config.Listing,
+		listFailures: new(uint64),
+
+		flights: newFlightGroup(),
+		locks:   newVolumeLocks(time.Duration(config.LockTimeout)),
+
+		autoCreate:     config.AutoCreateRepository,
+		repoProperties: config.RepositoryProperties,
+
+		endpoint:        endpoint,
+		statusFields:    statusFields,
+		statusSeparator: config.Status.Separator,
+
+		checkMountpoints: config.CheckMountpoints,
+		paths:            paths,
+	}, nil
 }
@@ -6,18 +6,24 @@ package forwarder
 
 import (
 	"context"
+	"encoding/json"
 	"github.com/stretchr/testify/assert"
 	"io/ioutil"
 	"net"
 	"net/http"
 	"net/http/httptest"
 	"testing"
+	"time"
 )
 
 func testForwarder(handler http.Handler) (Forwarder, func()) {
+	return testForwarderWithConfig(handler, DefaultConfig())
+}
+
+func testForwarderWithConfig(handler http.Handler, config Config) (Forwarder, func()) {
 	s := httptest.NewServer(handler)
 
-	cli := &http.Client{
+	config.HTTPClient = &http.Client{
 		Transport: &http.Transport{
 			DialContext: func(_ context.Context, network, _ string) (net.Conn, error) {
 				return net.Dial(network, s.Listener.Addr().String())
@@ -25,18 +31,23 @@ func testForwarder(handler http.Handler) (Forwarder, func()) {
 		},
 	}
 
-	return NewClient(cli), s.Close
+	f, err := NewWithConfig(config)
+	if err != nil {
+		s.Close()
+		panic(err)
+	}
+	return f, s.Close
 }
 
 func TestPluginActivate(t *testing.T) {
 	f := New("localhost", 5001)
-	resp := f.PluginActivate()
+	resp := f.PluginActivate(context.Background())
 	assert.Equal(t, resp.Implements[0], "VolumeDriver")
 }
 
 func TestVolumeDriverCapabilities(t *testing.T) {
 	f := New("localhost", 5001)
-	resp := f.VolumeCapabilities()
+	resp := f.VolumeCapabilities(context.Background())
 	assert.Equal(t, resp.Capabilities.Scope, "local")
 }
 
@@ -54,15 +65,17 @@ func TestListVolumes(t *testing.T) {
 	f, teardown := testForwarder(h)
 	defer teardown()
 
-	resp := f.ListVolumes()
+	resp := f.ListVolumes(context.Background())
 	if assert.Empty(t, resp.Err) &&
 		assert.Equal(t, len(resp.Volumes), 2) {
 		assert.Equal(t, resp.Volumes[0].Name, "foo/v0")
 		assert.Equal(t, resp.Volumes[0].Mountpoint, "/v0")
-		assert.Equal(t, len(resp.Volumes[0].Status), 0)
+		assert.Equal(t, resp.Volumes[0].Status, map[string]string{"active": "false", "mounts": "0",
+			"endpoint": "localhost:5001", "circuit": "closed"})
 		assert.Equal(t, resp.Volumes[1].Name, "foo/v1")
 		assert.Equal(t, resp.Volumes[1].Mountpoint, "/v1")
-		assert.Equal(t, len(resp.Volumes[1].Status), 0)
+		assert.Equal(t, resp.Volumes[1].Status, map[string]string{"active": "false", "mounts": "0",
+			"endpoint": "localhost:5001", "circuit": "closed"})
 	}
 }
 
@@ -76,7 +89,7 @@ func TestListVolumesRepoError(t *testing.T) {
 	f, teardown := testForwarder(h)
 	defer teardown()
 
-	resp := f.ListVolumes()
+	resp := f.ListVolumes(context.Background())
 	assert.Equal(t, resp.Err, "no such repository")
 }
 
@@ -94,7 +107,7 @@ func TestListVolumesVolumeError(t *testing.T) {
 	f, teardown := testForwarder(h)
 	defer teardown()
 
-	resp := f.ListVolumes()
+	resp := f.ListVolumes(context.Background())
 	assert.Equal(t, resp.Err, "no such volume")
 }
 
@@ -107,7 +120,7 @@ func TestGetVolume(t *testing.T) {
 	f, teardown := testForwarder(h)
 	defer teardown()
 
-	resp := f.GetVolume(VolumeRequest{Name: "foo/vol"})
+	resp := f.GetVolume(context.Background(), VolumeRequest{Name: "foo/vol"})
 	if assert.Empty(t, resp.Err) {
 		assert.Equal(t, resp.Volume.Name, "foo/vol")
 		assert.Equal(t, resp.Volume.Mountpoint, "/vol")
@@ -117,7 +130,7 @@ func TestGetVolume(t *testing.T) {
 func TestGetVolumeBadName(t *testing.T) {
 	f := New("localhost", 5001)
 
-	resp := f.GetVolume(VolumeRequest{Name: "foo"})
+	resp := f.GetVolume(context.Background(), VolumeRequest{Name: "foo"})
 	assert.Equal(t, resp.Err, "volume name must be of the form <repository>/<volume>")
 }
 
@@ -131,7 +144,7 @@ func TestGetVolumeError(t *testing.T) {
 	f, teardown := testForwarder(h)
 	defer teardown()
 
-	resp := f.GetVolume(VolumeRequest{Name: "foo/vol"})
+	resp := f.GetVolume(context.Background(), VolumeRequest{Name: "foo/vol"})
 	assert.Equal(t, resp.Err, "no such volume")
 }
 
@@ -144,7 +157,7 @@ func TestGetPath(t *testing.T) {
 	f, teardown := testForwarder(h)
 	defer teardown()
 
-	resp := f.GetPath(VolumeRequest{Name: "foo/vol"})
+	resp := f.GetPath(context.Background(), VolumeRequest{Name: "foo/vol"})
 	if assert.Empty(t, resp.Err) {
 		assert.Equal(t, resp.Mountpoint, "/vol")
 	}
@@ -160,7 +173,7 @@ func TestGetPathError(t *testing.T) {
 	f, teardown := testForwarder(h)
 	defer teardown()
 
-	resp := f.GetPath(VolumeRequest{Name: "foo/vol"})
+	resp := f.GetPath(context.Background(), VolumeRequest{Name: "foo/vol"})
 	assert.Equal(t, resp.Err, "no such volume")
 }
 
@@ -177,7 +190,8 @@ func TestCreateVolume(t *testing.T) {
 	f, teardown := testForwarder(h)
 	defer teardown()
 
-	resp := f.CreateVolume(CreateVolumeRequest{Name: "foo/vol", Opts: map[string]interface{}{"a": "b"}})
+	resp := f.CreateVolume(context.Background(), CreateVolumeRequest{Name: "foo/vol",
+		Opts: map[string]interface{}{"a": "b"}})
 	assert.Empty(t, resp.Err)
 }
 
@@ -194,14 +208,15 @@ func TestCreateVolumeNoOpts(t *testing.T) {
 	f, teardown := testForwarder(h)
 	defer teardown()
 
-	resp := f.CreateVolume(CreateVolumeRequest{Name: "foo/vol"})
+	resp := f.CreateVolume(context.Background(), CreateVolumeRequest{Name: "foo/vol"})
 	assert.Empty(t, resp.Err)
 }
 
 func TestCreateVolumeBadName(t *testing.T) {
 	f := New("localhost", 5001)
 
-	resp := f.CreateVolume(CreateVolumeRequest{Name: "foo", Opts: map[string]interface{}{"a": "b"}})
+	resp := f.CreateVolume(context.Background(), CreateVolumeRequest{Name: "foo",
+		Opts: map[string]interface{}{"a": "b"}})
 	assert.Equal(t, resp.Err, "volume name must be of the form <repository>/<volume>")
 }
 
@@ -215,7 +230,8 @@ func TestCreateVolumeError(t *testing.T) {
 	f, teardown := testForwarder(h)
 	defer teardown()
 
-	resp := f.CreateVolume(CreateVolumeRequest{Name: "foo/vol", Opts: map[string]interface{}{"a": "b"}})
+	resp := f.CreateVolume(context.Background(), CreateVolumeRequest{Name: "foo/vol",
+		Opts: map[string]interface{}{"a": "b"}})
 	assert.Equal(t, resp.Err, "no such repository")
 }
 
@@ -229,14 +245,14 @@ func TestRemoveVolume(t *testing.T) {
 	f, teardown := testForwarder(h)
 	defer teardown()
 
-	resp := f.RemoveVolume(VolumeRequest{Name: "foo/vol"})
+	resp := f.RemoveVolume(context.Background(), VolumeRequest{Name: "foo/vol"})
 	assert.Empty(t, resp.Err)
 }
 
 func TestRemoveVolumeBadName(t *testing.T) {
 	f := New("localhost", 5001)
 
-	resp := f.RemoveVolume(VolumeRequest{Name: "foo"})
+	resp := f.RemoveVolume(context.Background(), VolumeRequest{Name: "foo"})
 	assert.Equal(t, resp.Err, "volume name must be of the form <repository>/<volume>")
 }
 
@@ -250,7 +266,7 @@ func TestRemoveVolumeError(t *testing.T) {
 	f, teardown := testForwarder(h)
 	defer teardown()
 
-	resp := f.RemoveVolume(VolumeRequest{Name: "foo/vol"})
+	resp := f.RemoveVolume(context.Background(), VolumeRequest{Name: "foo/vol"})
 	assert.Equal(t, resp.Err, "no such repository")
 }
 
@@ -270,14 +286,14 @@ func TestMountVolume(t *testing.T) {
 	f, teardown := testForwarder(h)
 	defer teardown()
 
-	resp := f.MountVolume(MountVolumeRequest{Name: "foo/vol"})
+	resp := f.MountVolume(context.Background(), MountVolumeRequest{Name: "foo/vol"})
 	assert.Empty(t, resp.Err)
 }
 
 func TestMountVolumeBadName(t *testing.T) {
 	f := New("localhost", 5001)
 
-	resp := f.MountVolume(MountVolumeRequest{Name: "foo"})
+	resp := f.MountVolume(context.Background(), MountVolumeRequest{Name: "foo"})
 	assert.Equal(t, resp.Err, "volume name must be of the form <repository>/<volume>")
 }
 
@@ -298,7 +314,7 @@ func TestMountVolumeError(t *testing.T) {
 	f, teardown := testForwarder(h)
 	defer teardown()
 
-	resp := f.MountVolume(MountVolumeRequest{Name: "foo/vol"})
+	resp := f.MountVolume(context.Background(), MountVolumeRequest{Name: "foo/vol"})
 	assert.Equal(t, resp.Err, "no such repository")
 }
 
@@ -312,14 +328,14 @@ func TestUnmountVolume(t *testing.T) {
 	f, teardown := testForwarder(h)
 	defer teardown()
 
-	resp := f.UnmountVolume(MountVolumeRequest{Name: "foo/vol"})
+	resp := f.UnmountVolume(context.Background(), MountVolumeRequest{Name: "foo/vol"})
 	assert.Empty(t, resp.Err)
 }
 
 func TestUnmountVolumeBadName(t *testing.T) {
 	f := New("localhost", 5001)
 
-	resp := f.UnmountVolume(MountVolumeRequest{Name: "foo"})
+	resp := f.UnmountVolume(context.Background(), MountVolumeRequest{Name: "foo"})
 	assert.Equal(t, resp.Err, "volume name must be of the form <repository>/<volume>")
 }
 
@@ -334,6 +350,242 @@ func TestUnmountVolumeError(t *testing.T) {
 	f, teardown := testForwarder(h)
 	defer teardown()
 
-	resp := f.UnmountVolume(MountVolumeRequest{Name: "foo/vol"})
+	resp := f.UnmountVolume(context.Background(), MountVolumeRequest{Name: "foo/vol"})
 	assert.Equal(t, resp.Err, "no such repository")
 }
+
+func TestMountVolumeShared(t *testing.T) {
+	activations, deactivations := 0, 0
+	h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		switch r.RequestURI {
+		case "/v1/repositories/foo/volumes/vol":
+			w.Write([]byte("{\"name\":\"vol\",\"config\":{\"mountpoint\":\"/vol\"}}"))
+		case "/v1/repositories/foo/volumes/vol/activate":
+			activations++
+			w.WriteHeader(http.StatusNoContent)
+		case "/v1/repositories/foo/volumes/vol/deactivate":
+			deactivations++
+			w.WriteHeader(http.StatusNoContent)
+		default:
+			t.Errorf("unexpected request %s", r.RequestURI)
+		}
+	})
+	f, teardown := testForwarder(h)
+	defer teardown()
+
+	assert.Empty(t, f.MountVolume(context.Background(), MountVolumeRequest{Name: "foo/vol", ID: "a"}).Err)
+	assert.Empty(t, f.MountVolume(context.Background(), MountVolumeRequest{Name: "foo/vol", ID: "b"}).Err)
+	assert.Empty(t, f.MountVolume(context.Background(), MountVolumeRequest{Name: "foo/vol", ID: "b"}).Err)
+	assert.Equal(t, 1, activations)
+
+	assert.Empty(t, f.UnmountVolume(context.Background(), MountVolumeRequest{Name: "foo/vol", ID: "a"}).Err)
+	assert.Empty(t, f.UnmountVolume(context.Background(), MountVolumeRequest{Name: "foo/vol", ID: "c"}).Err)
+	assert.Equal(t, 0, deactivations)
+
+	assert.Empty(t, f.UnmountVolume(context.Background(), MountVolumeRequest{Name: "foo/vol", ID: "b"}).Err)
+	assert.Equal(t, 1, deactivations)
+
+	assert.Empty(t, f.MountVolume(context.Background(), MountVolumeRequest{Name: "foo/vol", ID: "d"}).Err)
+	assert.Equal(t, 2, activations)
+}
+
+func TestMountVolumeActivateFailure(t *testing.T) {
+	activations := 0
+	h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		if r.RequestURI == "/v1/repositories/foo/volumes/vol" {
+			w.Write([]byte("{\"name\":\"vol\",\"config\":{\"mountpoint\":\"/vol\"}}"))
+		} else {
+			assert.Equal(t, r.RequestURI, "/v1/repositories/foo/volumes/vol/activate")
+			activations++
+			if activations == 1 {
+				w.WriteHeader(http.StatusBadRequest)
+				w.Write([]byte("{\"message\":\"activate failed\"}"))
+			} else {
+				w.WriteHeader(http.StatusNoContent)
+			}
+		}
+	})
+	f, teardown := testForwarder(h)
+	defer teardown()
+
+	assert.Equal(t, "activate failed",
+		f.MountVolume(context.Background(), MountVolumeRequest{Name: "foo/vol", ID: "a"}).Err)
+	assert.Empty(t, f.MountVolume(context.Background(), MountVolumeRequest{Name: "foo/vol", ID: "a"}).Err)
+	assert.Equal(t, 2, activations)
+}
+
+func TestUnmountVolumeDeactivateFailure(t *testing.T) {
+	deactivations := 0
+	h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		switch r.RequestURI {
+		case "/v1/repositories/foo/volumes/vol":
+			w.Write([]byte("{\"name\":\"vol\",\"config\":{\"mountpoint\":\"/vol\"}}"))
+		case "/v1/repositories/foo/volumes/vol/activate":
+			w.WriteHeader(http.StatusNoContent)
+		default:
+			assert.Equal(t, r.RequestURI, "/v1/repositories/foo/volumes/vol/deactivate")
+			deactivations++
+			if deactivations == 1 {
+				w.WriteHeader(http.StatusBadRequest)
+				w.Write([]byte("{\"message\":\"deactivate failed\"}"))
+			} else {
+				w.WriteHeader(http.StatusNoContent)
+			}
+		}
+	})
+	f, teardown := testForwarder(h)
+	defer teardown()
+
+	assert.Empty(t, f.MountVolume(context.Background(), MountVolumeRequest{Name: "foo/vol", ID: "a"}).Err)
+	assert.Equal(t, "deactivate failed",
+		f.UnmountVolume(context.Background(), MountVolumeRequest{Name: "foo/vol", ID: "a"}).Err)
+	assert.Empty(t, f.UnmountVolume(context.Background(), MountVolumeRequest{Name: "foo/vol", ID: "a"}).Err)
+	assert.Equal(t, 2, deactivations)
+}
+
+func defaultRepoConfig() Config {
+	config := DefaultConfig()
+	config.DefaultRepository = "foo"
+	return config
+}
+
+func TestDefaultRepositoryBadName(t *testing.T) {
+	config := DefaultConfig()
+	config.DefaultRepository = "foo/bar"
+	_, err := NewWithConfig(config)
+	assert.Error(t, err)
+}
+
+func TestGetVolumeDefaultRepository(t *testing.T) {
+	h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		assert.Equal(t, r.RequestURI, "/v1/repositories/foo/volumes/vol")
+		w.Write([]byte("{\"name\":\"vol\",\"config\":{\"mountpoint\":\"/vol\"}}"))
+	})
+	f, teardown := testForwarderWithConfig(h, defaultRepoConfig())
+	defer teardown()
+
+	resp := f.GetVolume(context.Background(), VolumeRequest{Name: "vol"})
+	if assert.Empty(t, resp.Err) {
+		assert.Equal(t, resp.Volume.Name, "vol")
+	}
+
+	resp = f.GetVolume(context.Background(), VolumeRequest{Name: "foo/vol"})
+	if assert.Empty(t, resp.Err) {
+		assert.Equal(t, resp.Volume.Name, "foo/vol")
+	}
+}
+
+func TestCreateVolumeDefaultRepository(t *testing.T) {
+	h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		assert.Equal(t, r.RequestURI, "/v1/repositories/foo/volumes")
+		w.Write([]byte("{\"name\":\"vol\",\"config\":{},\"properties\":{}}"))
+	})
+	f, teardown := testForwarderWithConfig(h, defaultRepoConfig())
+	defer teardown()
+
+	resp := f.CreateVolume(context.Background(), CreateVolumeRequest{Name: "vol"})
+	assert.Empty(t, resp.Err)
+}
+
+func TestMountVolumeDefaultRepository(t *testing.T) {
+	h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		switch r.RequestURI {
+		case "/v1/repositories/foo/volumes/vol":
+			w.Write([]byte("{\"name\":\"vol\",\"config\":{\"mountpoint\":\"/vol\"}}"))
+		case "/v1/repositories/foo/volumes/vol/activate", "/v1/repositories/foo/volumes/vol/deactivate":
+			w.WriteHeader(http.StatusNoContent)
+		default:
+			t.Errorf("unexpected request %s", r.RequestURI)
+		}
+	})
+	f, teardown := testForwarderWithConfig(h, defaultRepoConfig())
+	defer teardown()
+
+	resp := f.MountVolume(context.Background(), MountVolumeRequest{Name: "vol", ID: "a"})
+	if assert.Empty(t, resp.Err) {
+		assert.Equal(t, resp.Mountpoint, "/vol")
+	}
+	assert.Empty(t, f.UnmountVolume(context.Background(), MountVolumeRequest{Name: "vol", ID: "a"}).Err)
+}
+
+func TestListVolumesDefaultRepository(t *testing.T) {
+	h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		if r.RequestURI == "/v1/repositories" {
+			w.Write([]byte("[{\"name\":\"foo\",\"properties\":{}},{\"name\":\"bar\",\"properties\":{}}]"))
+		} else {
+			w.Write([]byte("[{\"name\":\"v0\",\"config\":{\"mountpoint\":\"/v0\"}}]"))
+		}
+	})
+	f, teardown := testForwarderWithConfig(h, defaultRepoConfig())
+	defer teardown()
+
+	resp := f.ListVolumes(context.Background())
+	if assert.Empty(t, resp.Err) && assert.Equal(t, len(resp.Volumes), 2) {
+		assert.Equal(t, resp.Volumes[0].Name, "v0")
+		assert.Equal(t, resp.Volumes[1].Name, "bar/v0")
+	}
+}
+
+func TestGetVolumeTimeout(t *testing.T) {
+	done := make(chan struct{})
+	h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-done:
+		case <-time.After(5 * time.Second):
+		}
+	})
+	config := DefaultConfig()
+	config.Timeouts[EndpointGet] = Duration(50 * time.Millisecond)
+	f, teardown := testForwarderWithConfig(h, config)
+	defer teardown()
+	defer close(done)
+
+	resp := f.GetVolume(context.Background(), VolumeRequest{Name: "foo/vol"})
+	assert.Equal(t, TimeoutError, resp.Err)
+}
+
+func TestGetVolumeCanceled(t *testing.T) {
+	done := make(chan struct{})
+	h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-done:
+		case <-time.After(5 * time.Second):
+		}
+	})
+	f, teardown := testForwarder(h)
+	defer teardown()
+	defer close(done)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		cancel()
+	}()
+	resp := f.GetVolume(ctx, VolumeRequest{Name: "foo/vol"})
+	assert.Equal(t, CanceledError, resp.Err)
+}
+
+func TestTimeoutsBadEndpoint(t *testing.T) {
+	config := DefaultConfig()
+	config.Timeouts["VolumeDriver.Bogus"] = Duration(time.Second)
+	_, err := NewWithConfig(config)
+	assert.Error(t, err)
+}
+
+func TestDurationJSON(t *testing.T) {
+	var d Duration
+	if assert.NoError(t, json.Unmarshal([]byte("\"1m30s\""), &d)) {
+		assert.Equal(t, Duration(90*time.Second), d)
+	}
+	assert.Error(t, json.Unmarshal([]byte("90"), &d))
+	encoded, _ := json.Marshal(Duration(2 * time.Second))
+	assert.Equal(t, "\"2s\"", string(encoded))
+}
@@ -0,0 +1,264 @@
+/*
+ * Copyright The Titan Project Contributors.
+ */
+
+package forwarder
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/titan-data/titan-docker-proxy/internal/logging"
+	"sync"
+	"time"
+)
+
+/*
+ * A burst of container starts turns into a burst of activate calls, which titan-server doesn't cope with well. The
+ * limiter bounds the number of calls in flight to titan-server at once, and can also limit the rate of calls made on
+ * behalf of each endpoint with a token bucket. When calls have to queue for a slot, those made for Mount and Unmount
+ * are let through first, since containers are waiting on them, followed by everything else, with List last.
+ *
+ * Each attempt at a call is admitted separately, so that retries give up their slot while backing off. Calls that
+ * had to wait are logged along with how long they waited.
+ */
+type LimitsConfig struct {
+	// Maximum number of concurrent calls to titan-server. 0 means no limit.
+	MaxInFlight int `json:"maxInFlight"`
+	// Rate limits for calls made on behalf of each endpoint, keyed by endpoint name
+	Rates map[string]RateConfig `json:"rates"`
+}
+
+type RateConfig struct {
+	// Calls per second
+	Rate float64 `json:"rate"`
+	// Number of calls that can be made at once after a quiet period
+	Burst int `json:"burst"`
+}
+
+func (c LimitsConfig) validate() error {
+	if c.MaxInFlight < 0 {
+		return errors.New("maximum in-flight calls cannot be negative")
+	}
+	for endpoint, rate := range c.Rates {
+		if !isEndpoint(endpoint) {
+			return fmt.Errorf("invalid endpoint '%s' in rate limits", endpoint)
+		}
+		if rate.Rate <= 0 || rate.Burst < 1 {
+			return fmt.Errorf("invalid rate limit for endpoint '%s', rate and burst must be positive", endpoint)
+		}
+	}
+	return nil
+}
+
+type endpointKey struct{}
+
+/*
+ * Records which endpoint a context's calls are made on behalf of.
+ */
+func withEndpoint(ctx context.Context, endpoint string) context.Context {
+	return context.WithValue(ctx, endpointKey{}, endpoint)
+}
+
+func getEndpoint(ctx context.Context) string {
+	endpoint, _ := ctx.Value(endpointKey{}).(string)
+	return endpoint
+}
+
+const (
+	priorityHigh = iota
+	priorityNormal
+	priorityLow
+	priorities
+)
+
+func getPriority(endpoint string) int {
+	switch endpoint {
+	case EndpointMount, EndpointUnmount:
+		return priorityHigh
+	case EndpointList:
+		return priorityLow
+	}
+	return priorityNormal
+}
+
+type tokenBucket struct {
+	lock   sync.Mutex
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+/*
+ * Takes a token, returning how long the caller must wait before it may use it. Tokens can be taken ahead of time,
+ * which is what makes later callers wait longer.
+ */
+func (b *tokenBucket) reserve(now time.Time) time.Duration {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	b.tokens += now.Sub(b.last).Seconds() * b.rate
+	if b.tokens > b.burst {
+		b.tokens = b.burst
+	}
+	b.last = now
+	b.tokens--
+	if b.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-b.tokens / b.rate * float64(time.Second))
+}
+
+/*
+ * Gives back a token taken by a caller that gave up waiting for it.
+ */
+func (b *tokenBucket) cancel() {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	b.tokens++
+}
+
+type limiter struct {
+	lock     sync.Mutex
+	max      int
+	inFlight int
+	queues   [priorities][]chan struct{}
+	buckets  map[string]*tokenBucket
+	log      *logging.Logger
+}
+
+func newLimiter(config LimitsConfig, log *logging.Logger) *limiter {
+	l := &limiter{
+		max:     config.MaxInFlight,
+		buckets: map[string]*tokenBucket{},
+		log:     log,
+	}
+	now := time.Now()
+	for endpoint, rate := range config.Rates {
+		l.buckets[endpoint] = &tokenBucket{
+			rate:   rate.Rate,
+			burst:  float64(rate.Burst),
+			tokens: float64(rate.Burst),
+			last:   now,
+		}
+	}
+	return l
+}
+
+/*
+ * Waits until a call may be made on behalf of the context's endpoint, returning a function that must be called once
+ * the call is complete. Fails only if the context is done first.
+ */
+func (l *limiter) acquire(ctx context.Context) (func(), error) {
+	endpoint := getEndpoint(ctx)
+	start := time.Now()
+	waited := false
+
+	bucket, limited := l.buckets[endpoint]
+	if limited {
+		if wait := bucket.reserve(start); wait > 0 {
+			waited = true
+			timer := time.NewTimer(wait)
+			select {
+			case <-timer.C:
+			case <-ctx.Done():
+				timer.Stop()
+				bucket.cancel()
+				return nil, ctx.Err()
+			}
+		}
+	}
+
+	queued, err := l.admit(ctx, getPriority(endpoint))
+	if err != nil {
+		if limited {
+			bucket.cancel()
+		}
+		return nil, err
+	}
+
+	if waited || queued {
+		l.log.Info("call to titan-server was queued", logging.Endpoint(describeEndpoint(endpoint)),
+			logging.F("queued", time.Since(start).Round(time.Millisecond)))
+	}
+	return l.release, nil
+}
+
+func describeEndpoint(endpoint string) string {
+	if endpoint == "" {
+		return "background"
+	}
+	return endpoint
+}
+
+/*
+ * Takes an in-flight slot, queueing behind any callers of the same or higher priority if none are free. Returns
+ * whether the caller had to queue.
+ */
+func (l *limiter) admit(ctx context.Context, priority int) (bool, error) {
+	if l.max == 0 {
+		return false, nil
+	}
+	l.lock.Lock()
+	if l.inFlight < l.max && l.queued() == 0 {
+		l.inFlight++
+		l.lock.Unlock()
+		return false, nil
+	}
+	ready := make(chan struct{})
+	l.queues[priority] = append(l.queues[priority], ready)
+	l.lock.Unlock()
+
+	select {
+	case <-ready:
+		return true, nil
+	case <-ctx.Done():
+		l.lock.Lock()
+		defer l.lock.Unlock()
+		for i, waiter := range l.queues[priority] {
+			if waiter == ready {
+				l.queues[priority] = append(l.queues[priority][:i], l.queues[priority][i+1:]...)
+				return true, ctx.Err()
+			}
+		}
+		// We were handed a slot just as we gave up, so pass it on
+		l.handoff()
+		return true, ctx.Err()
+	}
+}
+
+/*
+ * Frees an in-flight slot, handing it straight to the highest priority caller waiting for one.
+ */
+func (l *limiter) release() {
+	if l.max == 0 {
+		return
+	}
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	l.handoff()
+}
+
+/*
+ * Passes a slot that is no longer needed on to the next waiter, if any. Must be called with the lock held.
+ */
+func (l *limiter) handoff() {
+	for priority := range l.queues {
+		if len(l.queues[priority]) != 0 {
+			ready := l.queues[priority][0]
+			l.queues[priority] = l.queues[priority][1:]
+			close(ready)
+			return
+		}
+	}
+	l.inFlight--
+}
+
+func (l *limiter) queued() int {
+	count := 0
+	for _, queue := range l.queues {
+		count += len(queue)
+	}
+	return count
+}
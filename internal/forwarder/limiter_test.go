@@ -0,0 +1,159 @@
+/*
+ * Copyright The Titan Project Contributors.
+ */
+
+package forwarder
+
+import (
+	"context"
+	"github.com/stretchr/testify/assert"
+	"github.com/titan-data/titan-docker-proxy/internal/logging"
+	"testing"
+	"time"
+)
+
+func TestTokenBucket(t *testing.T) {
+	now := time.Now()
+	b := &tokenBucket{rate: 10, burst: 2, tokens: 2, last: now}
+
+	assert.Equal(t, time.Duration(0), b.reserve(now))
+	assert.Equal(t, time.Duration(0), b.reserve(now))
+	assert.Equal(t, 100*time.Millisecond, b.reserve(now))
+	assert.Equal(t, 200*time.Millisecond, b.reserve(now))
+
+	b.cancel()
+	b.cancel()
+	assert.Equal(t, time.Duration(0), b.reserve(now.Add(150*time.Millisecond)))
+}
+
+func TestLimiterRate(t *testing.T) {
+	l := newLimiter(LimitsConfig{Rates: map[string]RateConfig{EndpointGet: {Rate: 20, Burst: 1}}}, logging.Discard())
+	ctx := withEndpoint(context.Background(), EndpointGet)
+
+	start := time.Now()
+	for i := 0; i < 3; i++ {
+		release, err := l.acquire(ctx)
+		assert.NoError(t, err)
+		release()
+	}
+	assert.True(t, time.Since(start) >= 90*time.Millisecond)
+
+	// Other endpoints aren't limited
+	start = time.Now()
+	release, _ := l.acquire(withEndpoint(context.Background(), EndpointMount))
+	release()
+	assert.True(t, time.Since(start) < 40*time.Millisecond)
+}
+
+/*
+ * Waits until the given number of callers are queued for a slot.
+ */
+func waitForQueued(t *testing.T, l *limiter, count int) {
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		l.lock.Lock()
+		queued := l.queued()
+		l.lock.Unlock()
+		if queued == count {
+			return
+		}
+		time.Sleep(time.Millisecond)
+	}
+	t.Errorf("timed out waiting for %d queued callers", count)
+}
+
+func TestLimiterPriority(t *testing.T) {
+	l := newLimiter(LimitsConfig{MaxInFlight: 1}, logging.Discard())
+	release, err := l.acquire(withEndpoint(context.Background(), EndpointList))
+	assert.NoError(t, err)
+
+	order := make(chan string, 3)
+	admit := func(endpoint string) {
+		release, err := l.acquire(withEndpoint(context.Background(), endpoint))
+		if assert.NoError(t, err) {
+			order <- endpoint
+			release()
+		}
+	}
+	go admit(EndpointList)
+	waitForQueued(t, l, 1)
+	go admit(EndpointGet)
+	waitForQueued(t, l, 2)
+	go admit(EndpointMount)
+	waitForQueued(t, l, 3)
+
+	release()
+	assert.Equal(t, EndpointMount, <-order)
+	assert.Equal(t, EndpointGet, <-order)
+	assert.Equal(t, EndpointList, <-order)
+
+	l.lock.Lock()
+	assert.Equal(t, 0, l.inFlight)
+	l.lock.Unlock()
+}
+
+func TestLimiterCanceled(t *testing.T) {
+	l := newLimiter(LimitsConfig{MaxInFlight: 1}, logging.Discard())
+	release, _ := l.acquire(context.Background())
+
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		waitForQueued(t, l, 1)
+		cancel()
+	}()
+	_, err := l.acquire(ctx)
+	assert.Equal(t, context.Canceled, err)
+
+	release()
+	release, err = l.acquire(context.Background())
+	assert.NoError(t, err)
+	release()
+}
+
+func TestLimiterCanceledReturnsToken(t *testing.T) {
+	l := newLimiter(LimitsConfig{MaxInFlight: 1, Rates: map[string]RateConfig{EndpointGet: {Rate: 0.001, Burst: 1}}},
+		logging.Discard())
+	release, _ := l.acquire(context.Background())
+
+	// The token is available, but the slot isn't, so the token must be given back when the caller gives up
+	ctx, cancel := context.WithCancel(withEndpoint(context.Background(), EndpointGet))
+	go func() {
+		waitForQueued(t, l, 1)
+		cancel()
+	}()
+	_, err := l.acquire(ctx)
+	assert.Equal(t, context.Canceled, err)
+	release()
+
+	ctx, cancel = context.WithTimeout(withEndpoint(context.Background(), EndpointGet), time.Second)
+	defer cancel()
+	release, err = l.acquire(ctx)
+	if assert.NoError(t, err) {
+		release()
+	}
+}
+
+func TestLimitMaxInFlight(t *testing.T) {
+	s := &listServer{repositories: 10}
+	config := DefaultConfig()
+	config.Listing.Concurrency = 5
+	config.Limits.MaxInFlight = 2
+	f, teardown := testForwarderWithConfig(s, config)
+	defer teardown()
+
+	resp := f.ListVolumes(context.Background())
+	assert.Empty(t, resp.Err)
+	assert.Len(t, resp.Volumes, 10)
+	assert.Equal(t, int32(2), s.maxInFlight)
+}
+
+func TestLimitsInvalid(t *testing.T) {
+	config := DefaultConfig()
+	config.Limits.Rates = map[string]RateConfig{"VolumeDriver.Bogus": {Rate: 1, Burst: 1}}
+	_, err := NewWithConfig(config)
+	assert.Error(t, err)
+
+	config.Limits.Rates = map[string]RateConfig{EndpointGet: {Rate: 0, Burst: 1}}
+	_, err = NewWithConfig(config)
+	assert.Error(t, err)
+}
@@ -0,0 +1,176 @@
+/*
+ * Copyright The Titan Project Contributors.
+ */
+
+package forwarder
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	titan "github.com/titan-data/titan-client-go"
+	"github.com/titan-data/titan-docker-proxy/internal/logging"
+	"sync"
+	"sync/atomic"
+)
+
+/*
+ * Listing volumes requires a call to titan-server for every repository, so rather than making them one after the
+ * other, they are fanned out to a bounded pool of workers. Each repository's results land in its own slot so that
+ * the final ordering matches the order titan-server returned the repositories in.
+ *
+ * By default the first failure cancels any outstanding work and fails the whole listing. Docker treats a volume
+ * missing from the list as gone, though, so a single broken repository can make every other volume disappear. In
+ * partial mode, failed repositories are logged and skipped instead, and the listing only fails once more than the
+ * configured fraction of repositories (or all of them) have failed. Every repository is still listed in that case, so
+ * that the error reports how many actually failed.
+ */
+type ListingConfig struct {
+	// Maximum number of repositories whose volumes are listed concurrently
+	Concurrency int `json:"concurrency"`
+	// Whether to return the volumes of healthy repositories when others fail
+	Partial bool `json:"partial"`
+	// In partial mode, the largest fraction of repositories that may fail before the listing returns an error
+	MaxFailedRatio float64 `json:"maxFailedRatio"`
+}
+
+func (c ListingConfig) validate() error {
+	if c.Concurrency < 1 {
+		return errors.New("list concurrency must be at least 1")
+	}
+	if c.MaxFailedRatio < 0 || c.MaxFailedRatio > 1 {
+		return fmt.Errorf("invalid list failure ratio %g, must be between 0 and 1", c.MaxFailedRatio)
+	}
+	return nil
+}
+
+/*
+ * Returns how many of the given number of repositories may fail without failing the listing.
+ */
+func (c ListingConfig) allowedFailures(repositories int) int {
+	if !c.Partial || repositories == 0 {
+		return 0
+	}
+	allowed := int(c.MaxFailedRatio * float64(repositories))
+	if allowed >= repositories {
+		allowed = repositories - 1
+	}
+	return allowed
+}
+
+type repositoryListing struct {
+	volumes []Volume
+	err     error
+}
+
+func (p forwarder) listRepository(ctx context.Context, repoName string) repositoryListing {
+	volumes, _, err := p.client.ListVolumes(ctx, repoName)
+	if err != nil {
+		return repositoryListing{err: err}
+	}
+
+	ret := repositoryListing{volumes: []Volume{}}
+	repoStatus := p.repositoryStatus(ctx, repoName)
+	for _, vol := range volumes {
+		// Docker would act on a different volume, or none at all, given a name that doesn't parse back to this one
+		if _, err := formatName(p.names, repoName, vol.Name); err != nil {
+			p.log.Warn("not listing volume, as docker would be unable to refer to it",
+				logging.Volume(mountKey(repoName, vol.Name)), errorField(err))
+			continue
+		}
+		converted, err := p.convertVolume(repoName, vol, repoStatus)
+		if err != nil {
+			// The mountpoint is optional when listing, so report the volume without it
+			p.log.Warn("listing volume without a mountpoint", logging.Volume(mountKey(repoName, vol.Name)),
+				errorField(err))
+			converted = Volume{
+				Name:   p.names.Format(repoName, vol.Name),
+				Status: p.volumeStatus(repoName, vol, repoStatus),
+			}
+		}
+		ret.volumes = append(ret.volumes, converted)
+	}
+	return ret
+}
+
+/*
+ * Lists the volumes in every repository, returning the volumes in repository order, or the error that stopped the
+ * listing.
+ */
+func (p forwarder) listRepositories(ctx context.Context, repositories []titan.Repository) ([]Volume, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	results := make([]repositoryListing, len(repositories))
+	allowed := p.listing.allowedFailures(len(repositories))
+	var failed int
+	var failure error
+	var failureLock sync.Mutex
+
+	workers := p.listing.Concurrency
+	if workers > len(repositories) {
+		workers = len(repositories)
+	}
+
+	jobs := make(chan int)
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for idx := range jobs {
+				results[idx] = p.listRepository(ctx, repositories[idx].Name)
+				if results[idx].err == nil {
+					continue
+				}
+
+				failureLock.Lock()
+				failed++
+				if failure == nil {
+					failure = results[idx].err
+				}
+				if p.listing.Partial {
+					total := atomic.AddUint64(p.listFailures, 1)
+					msg := "unable to list volumes in repository, skipping it"
+					if failed > allowed {
+						msg = "unable to list volumes in repository, too many have failed to skip it"
+					}
+					p.log.Warn(msg, logging.Repository(repositories[idx].Name), logging.F("failuresTotal", total),
+						errorField(results[idx].err))
+				} else {
+					// Once the listing has failed, everything else is just fallout from canceling it
+					cancel()
+				}
+				failureLock.Unlock()
+			}
+		}()
+	}
+
+dispatch:
+	for i := range repositories {
+		select {
+		case jobs <- i:
+		case <-ctx.Done():
+			break dispatch
+		}
+	}
+	close(jobs)
+	wg.Wait()
+
+	if failed > allowed {
+		if !p.listing.Partial {
+			return nil, failure
+		}
+		return nil, fmt.Errorf("unable to list volumes in %d of %d repositories: %s", failed, len(repositories),
+			getErrorString(failure))
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	ret := []Volume{}
+	for _, result := range results {
+		ret = append(ret, result.volumes...)
+	}
+	return ret, nil
+}
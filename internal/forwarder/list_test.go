@@ -0,0 +1,186 @@
+/*
+ * Copyright The Titan Project Contributors.
+ */
+
+package forwarder
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"github.com/titan-data/titan-docker-proxy/internal/logging"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+/*
+ * Serves a number of repositories, each with a single volume. Later repositories respond faster, so that results
+ * arrive out of order.
+ */
+type listServer struct {
+	repositories int
+	failing      map[string]bool
+	inFlight     int32
+	maxInFlight  int32
+	requests     int32
+	lock         sync.Mutex
+}
+
+func (s *listServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if r.RequestURI == "/v1/repositories" {
+		repos := []string{}
+		for i := 0; i < s.repositories; i++ {
+			repos = append(repos, fmt.Sprintf("{\"name\":\"r%d\",\"properties\":{}}", i))
+		}
+		w.Write([]byte("[" + strings.Join(repos, ",") + "]"))
+		return
+	}
+
+	atomic.AddInt32(&s.requests, 1)
+	current := atomic.AddInt32(&s.inFlight, 1)
+	defer atomic.AddInt32(&s.inFlight, -1)
+	s.lock.Lock()
+	if current > s.maxInFlight {
+		s.maxInFlight = current
+	}
+	s.lock.Unlock()
+
+	var repo string
+	var idx int
+	fmt.Sscanf(strings.TrimPrefix(r.RequestURI, "/v1/repositories/"), "r%d", &idx)
+	repo = fmt.Sprintf("r%d", idx)
+	time.Sleep(time.Duration(s.repositories-idx) * 2 * time.Millisecond)
+
+	if s.failing[repo] {
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte(fmt.Sprintf("{\"message\":\"no such repository %s\"}", repo)))
+		return
+	}
+	w.Write([]byte("[{\"name\":\"v\",\"config\":{\"mountpoint\":\"/v\"}}]"))
+}
+
+func TestListVolumesConcurrent(t *testing.T) {
+	s := &listServer{repositories: 20}
+	config := DefaultConfig()
+	config.Listing.Concurrency = 3
+	f, teardown := testForwarderWithConfig(s, config)
+	defer teardown()
+
+	resp := f.ListVolumes(context.Background())
+	if assert.Empty(t, resp.Err) && assert.Len(t, resp.Volumes, 20) {
+		for i, vol := range resp.Volumes {
+			assert.Equal(t, fmt.Sprintf("r%d/v", i), vol.Name)
+		}
+	}
+	assert.True(t, s.maxInFlight <= 3)
+	assert.True(t, s.maxInFlight > 1)
+}
+
+func TestListVolumesConcurrentError(t *testing.T) {
+	s := &listServer{repositories: 20, failing: map[string]bool{"r0": true}}
+	config := DefaultConfig()
+	config.Listing.Concurrency = 2
+	f, teardown := testForwarderWithConfig(s, config)
+	defer teardown()
+
+	resp := f.ListVolumes(context.Background())
+	assert.Equal(t, "no such repository r0", resp.Err)
+	assert.True(t, atomic.LoadInt32(&s.requests) < 20)
+}
+
+func TestListVolumesCanceled(t *testing.T) {
+	s := &listServer{repositories: 50}
+	config := DefaultConfig()
+	config.Listing.Concurrency = 1
+	f, teardown := testForwarderWithConfig(s, config)
+	defer teardown()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		cancel()
+	}()
+	resp := f.ListVolumes(ctx)
+	assert.Equal(t, CanceledError, resp.Err)
+	assert.True(t, atomic.LoadInt32(&s.requests) < 50)
+}
+
+func TestListConcurrencyInvalid(t *testing.T) {
+	config := DefaultConfig()
+	config.Listing.Concurrency = 0
+	_, err := NewWithConfig(config)
+	assert.Error(t, err)
+}
+
+func partialConfig(ratio float64) Config {
+	config := DefaultConfig()
+	config.Listing.Partial = true
+	config.Listing.MaxFailedRatio = ratio
+	return config
+}
+
+func TestListVolumesPartial(t *testing.T) {
+	s := &listServer{repositories: 4, failing: map[string]bool{"r1": true}}
+	f, teardown := testForwarderWithConfig(s, partialConfig(0.25))
+	defer teardown()
+
+	resp := f.ListVolumes(context.Background())
+	if assert.Empty(t, resp.Err) && assert.Len(t, resp.Volumes, 3) {
+		assert.Equal(t, "r0/v", resp.Volumes[0].Name)
+		assert.Equal(t, "r2/v", resp.Volumes[1].Name)
+		assert.Equal(t, "r3/v", resp.Volumes[2].Name)
+	}
+	assert.Equal(t, uint64(1), *f.(forwarder).listFailures)
+}
+
+func TestListVolumesPartialThreshold(t *testing.T) {
+	s := &listServer{repositories: 4, failing: map[string]bool{"r1": true, "r2": true}}
+	f, teardown := testForwarderWithConfig(s, partialConfig(0.25))
+	defer teardown()
+
+	resp := f.ListVolumes(context.Background())
+	assert.Regexp(t, "^unable to list volumes in 2 of 4 repositories: no such repository r[12]$", resp.Err)
+	assert.Nil(t, resp.Volumes)
+}
+
+func TestListVolumesPartialCountsEveryFailure(t *testing.T) {
+	s := &listServer{repositories: 4, failing: map[string]bool{"r0": true, "r1": true, "r2": true}}
+	var buf bytes.Buffer
+	config := partialConfig(0.25)
+	config.Listing.Concurrency = 1
+	config.Logger = logging.New(&buf, logging.LevelWarn, logging.FormatText)
+	f, teardown := testForwarderWithConfig(s, config)
+	defer teardown()
+
+	resp := f.ListVolumes(context.Background())
+	assert.Equal(t, "unable to list volumes in 3 of 4 repositories: no such repository r0", resp.Err)
+	assert.Equal(t, int32(4), s.requests)
+	assert.Equal(t, uint64(3), *f.(forwarder).listFailures)
+
+	logged := buf.String()
+	assert.Contains(t, logged, "msg=\"unable to list volumes in repository, skipping it\" repository=r0 ")
+	assert.Contains(t, logged, "msg=\"unable to list volumes in repository, too many have failed to skip it\" "+
+		"repository=r1 ")
+	assert.Contains(t, logged, "msg=\"unable to list volumes in repository, too many have failed to skip it\" "+
+		"repository=r2 ")
+}
+
+func TestListVolumesPartialAllFailed(t *testing.T) {
+	s := &listServer{repositories: 2, failing: map[string]bool{"r0": true, "r1": true}}
+	f, teardown := testForwarderWithConfig(s, partialConfig(1))
+	defer teardown()
+
+	resp := f.ListVolumes(context.Background())
+	assert.Regexp(t, "^unable to list volumes in 2 of 2 repositories", resp.Err)
+}
+
+func TestListFailureRatioInvalid(t *testing.T) {
+	_, err := NewWithConfig(partialConfig(1.5))
+	assert.Error(t, err)
+}
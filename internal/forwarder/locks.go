@@ -0,0 +1,128 @@
+/*
+ * Copyright The Titan Project Contributors.
+ */
+
+package forwarder
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+/*
+ * Docker requests are each handled on their own goroutine, so without coordination a Remove can reach titan-server
+ * in the middle of a Mount of the same volume. Every operation that changes a volume holds that volume's lock for its
+ * whole duration, which serializes them per volume while letting operations on different volumes run in parallel.
+ *
+ * Operations that need more than one lock take them all at once, always in sorted order so that two such operations
+ * can never deadlock each other. Waiting for a lock is bounded by the request's own deadline, as well as the lock
+ * timeout, so that a stuck operation doesn't hold up every later request for the volume indefinitely.
+ */
+type volumeLocks struct {
+	lock    sync.Mutex
+	locks   map[string]*volumeLock
+	timeout time.Duration
+}
+
+type volumeLock struct {
+	held chan struct{}
+	// Number of holders and waiters, so that the lock can be dropped once nobody needs it
+	refs int
+}
+
+func newVolumeLocks(timeout time.Duration) *volumeLocks {
+	return &volumeLocks{
+		locks:   map[string]*volumeLock{},
+		timeout: timeout,
+	}
+}
+
+func volumeLockKey(repo string, volume string) string {
+	return "volume " + mountKey(repo, volume)
+}
+
+func repositoryLockKey(repo string) string {
+	return "repository " + repo
+}
+
+/*
+ * Takes the locks for all of the given keys, returning a function to release them. If any lock can't be taken before
+ * the timeout or the context is done, none are held on return.
+ */
+func (l *volumeLocks) acquire(ctx context.Context, keys ...string) (func(), error) {
+	sorted := []string{}
+	seen := map[string]bool{}
+	for _, key := range keys {
+		if !seen[key] {
+			seen[key] = true
+			sorted = append(sorted, key)
+		}
+	}
+	sort.Strings(sorted)
+
+	waitCtx := ctx
+	if l.timeout > 0 {
+		var cancel context.CancelFunc
+		waitCtx, cancel = context.WithTimeout(ctx, l.timeout)
+		defer cancel()
+	}
+
+	held := []string{}
+	release := func() {
+		for i := len(held) - 1; i >= 0; i-- {
+			l.release(held[i])
+		}
+	}
+	for _, key := range sorted {
+		if err := l.take(waitCtx, key); err != nil {
+			release()
+			if ctx.Err() != nil {
+				return nil, ctx.Err()
+			}
+			return nil, fmt.Errorf("timed out waiting for another operation on %s", key)
+		}
+		held = append(held, key)
+	}
+	return release, nil
+}
+
+func (l *volumeLocks) take(ctx context.Context, key string) error {
+	l.lock.Lock()
+	vl, ok := l.locks[key]
+	if !ok {
+		vl = &volumeLock{held: make(chan struct{}, 1)}
+		l.locks[key] = vl
+	}
+	vl.refs++
+	l.lock.Unlock()
+
+	select {
+	case vl.held <- struct{}{}:
+		return nil
+	case <-ctx.Done():
+		l.unref(key, vl)
+		return ctx.Err()
+	}
+}
+
+func (l *volumeLocks) release(key string) {
+	l.lock.Lock()
+	vl := l.locks[key]
+	l.lock.Unlock()
+
+	<-vl.held
+	l.unref(key, vl)
+}
+
+func (l *volumeLocks) unref(key string, vl *volumeLock) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	vl.refs--
+	if vl.refs == 0 {
+		delete(l.locks, key)
+	}
+}
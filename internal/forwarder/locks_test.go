@@ -0,0 +1,156 @@
+/*
+ * Copyright The Titan Project Contributors.
+ */
+
+package forwarder
+
+import (
+	"context"
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestLockSerializes(t *testing.T) {
+	locks := newVolumeLocks(0)
+	unlock, err := locks.acquire(context.Background(), "a")
+	assert.NoError(t, err)
+
+	acquired := make(chan struct{})
+	go func() {
+		unlock, _ := locks.acquire(context.Background(), "a")
+		close(acquired)
+		unlock()
+	}()
+
+	select {
+	case <-acquired:
+		t.Fatal("lock acquired while held")
+	case <-time.After(20 * time.Millisecond):
+	}
+	unlock()
+	<-acquired
+}
+
+func TestLockDifferentKeys(t *testing.T) {
+	locks := newVolumeLocks(0)
+	unlockA, err := locks.acquire(context.Background(), "a")
+	assert.NoError(t, err)
+	defer unlockA()
+
+	unlockB, err := locks.acquire(context.Background(), "b")
+	assert.NoError(t, err)
+	unlockB()
+}
+
+func TestLockTimeout(t *testing.T) {
+	locks := newVolumeLocks(10 * time.Millisecond)
+	unlock, _ := locks.acquire(context.Background(), "a")
+	defer unlock()
+
+	_, err := locks.acquire(context.Background(), "b", "a")
+	assert.EqualError(t, err, "timed out waiting for another operation on a")
+
+	// The lock on b must have been released again
+	unlockB, err := locks.acquire(context.Background(), "b")
+	assert.NoError(t, err)
+	unlockB()
+}
+
+func TestLockCanceled(t *testing.T) {
+	locks := newVolumeLocks(time.Minute)
+	unlock, _ := locks.acquire(context.Background(), "a")
+	defer unlock()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err := locks.acquire(ctx, "a")
+	assert.Equal(t, context.Canceled, err)
+}
+
+func TestLockOrdering(t *testing.T) {
+	locks := newVolumeLocks(time.Second)
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			unlock, err := locks.acquire(context.Background(), "a", "b", "a")
+			if assert.NoError(t, err) {
+				unlock()
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			unlock, err := locks.acquire(context.Background(), "b", "a")
+			if assert.NoError(t, err) {
+				unlock()
+			}
+		}()
+	}
+	wg.Wait()
+	assert.Empty(t, locks.locks)
+}
+
+/*
+ * Tracks how many requests are in progress for each volume, recording the most seen at once.
+ */
+type overlapHandler struct {
+	lock       sync.Mutex
+	inFlight   map[string]int
+	maxOverlap int32
+}
+
+func (h *overlapHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(r.URL.Path, "/")
+	volume := strings.Join(parts[:6], "/")
+
+	h.lock.Lock()
+	h.inFlight[volume]++
+	if n := int32(h.inFlight[volume]); n > atomic.LoadInt32(&h.maxOverlap) {
+		atomic.StoreInt32(&h.maxOverlap, n)
+	}
+	h.lock.Unlock()
+
+	time.Sleep(5 * time.Millisecond)
+
+	h.lock.Lock()
+	h.inFlight[volume]--
+	h.lock.Unlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	if r.Method == "DELETE" {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	w.Write([]byte("{\"name\":\"vol\",\"config\":{\"mountpoint\":\"/vol\"},\"properties\":{}}"))
+}
+
+func TestMountRemoveSerialized(t *testing.T) {
+	h := &overlapHandler{inFlight: map[string]int{}}
+	f, teardown := testForwarderWithConfig(h, DefaultConfig())
+	defer teardown()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 5; i++ {
+		wg.Add(3)
+		go func() {
+			defer wg.Done()
+			f.MountVolume(context.Background(), MountVolumeRequest{Name: "foo/vol", ID: "a"})
+		}()
+		go func() {
+			defer wg.Done()
+			f.UnmountVolume(context.Background(), MountVolumeRequest{Name: "foo/vol", ID: "a"})
+		}()
+		go func() {
+			defer wg.Done()
+			f.RemoveVolume(context.Background(), VolumeRequest{Name: "foo/vol"})
+		}()
+	}
+	wg.Wait()
+	assert.Equal(t, int32(1), h.maxOverlap)
+}
@@ -0,0 +1,108 @@
+/*
+ * Copyright The Titan Project Contributors.
+ */
+
+package forwarder
+
+import (
+	"fmt"
+	titan "github.com/titan-data/titan-client-go"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+/*
+ * titan-server typically runs in a container, so the mountpoints it reports are paths within its own mount namespace
+ * and not necessarily the docker host's. Rewrite rules replace a leading path prefix (matched on whole path
+ * components) with another, and the longest matching prefix wins. If an allowed root is configured, every mountpoint
+ * we hand back to docker must fall within it, whether or not it was rewritten.
+ */
+type PathRewrite struct {
+	From string `json:"from"`
+	To   string `json:"to"`
+}
+
+type pathRewriter struct {
+	rules []PathRewrite
+	root  string
+}
+
+func isCleanAbs(path string) bool {
+	return filepath.IsAbs(path) && filepath.Clean(path) == path
+}
+
+func hasPathPrefix(path string, prefix string) bool {
+	return path == prefix || prefix == "/" || strings.HasPrefix(path, prefix+"/")
+}
+
+func newPathRewriter(rules []PathRewrite, root string) (pathRewriter, error) {
+	r := pathRewriter{
+		rules: []PathRewrite{},
+		root:  root,
+	}
+	if root != "" && !isCleanAbs(root) {
+		return r, fmt.Errorf("invalid mount root '%s', must be an absolute path", root)
+	}
+	for _, rule := range rules {
+		if !isCleanAbs(rule.From) || !isCleanAbs(rule.To) {
+			return r, fmt.Errorf("invalid path rewrite '%s' -> '%s', paths must be absolute", rule.From, rule.To)
+		}
+		r.rules = append(r.rules, rule)
+	}
+	sort.SliceStable(r.rules, func(i, j int) bool {
+		return len(r.rules[i].From) > len(r.rules[j].From)
+	})
+	return r, nil
+}
+
+func (r pathRewriter) translate(path string) (string, error) {
+	for _, rule := range r.rules {
+		if hasPathPrefix(path, rule.From) {
+			path = filepath.Join(rule.To, strings.TrimPrefix(path, rule.From))
+			break
+		}
+	}
+	if r.root != "" && !hasPathPrefix(path, r.root) {
+		return "", fmt.Errorf("mountpoint %s is outside of the allowed root %s", path, r.root)
+	}
+	return path, nil
+}
+
+/*
+ * Titan reports the mountpoint of a volume in its server-generated configuration. We can't trust that it's there or
+ * that it's well formed, and docker will happily bind mount whatever we hand back, so the mountpoint must be an
+ * absolute, clean path. It is then translated to the host's view of the path. Checking that the path exists is
+ * optional, since it only makes sense when the proxy shares a filesystem with docker, and is only done for Mount and
+ * Path, where docker is about to use the path.
+ */
+func (p forwarder) getMountpoint(repoName string, vol titan.Volume) (string, error) {
+	raw, ok := vol.Config["mountpoint"]
+	if !ok {
+		return "", fmt.Errorf("volume %s/%s has no mountpoint", repoName, vol.Name)
+	}
+	path, ok := raw.(string)
+	if !ok {
+		return "", fmt.Errorf("volume %s/%s has invalid mountpoint '%v'", repoName, vol.Name, raw)
+	}
+	if !isCleanAbs(path) {
+		return "", fmt.Errorf("volume %s/%s has invalid mountpoint '%s', must be an absolute path", repoName,
+			vol.Name, path)
+	}
+	return p.paths.translate(path)
+}
+
+func (p forwarder) checkMountpoint(repoName string, volumeName string, path string) error {
+	if !p.checkMountpoints {
+		return nil
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		return fmt.Errorf("mountpoint %s of volume %s/%s is not accessible: %w", path, repoName, volumeName, err)
+	}
+	if !info.IsDir() {
+		return fmt.Errorf("mountpoint %s of volume %s/%s is not a directory", path, repoName, volumeName)
+	}
+	return nil
+}
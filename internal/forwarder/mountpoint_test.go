@@ -0,0 +1,182 @@
+/*
+ * Copyright The Titan Project Contributors.
+ */
+
+package forwarder
+
+import (
+	"context"
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func mountpointHandler(config string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		switch r.RequestURI {
+		case "/v1/repositories":
+			w.Write([]byte("[{\"name\":\"foo\",\"properties\":{}}]"))
+		case "/v1/repositories/foo/volumes":
+			w.Write([]byte("[{\"name\":\"vol\",\"config\":" + config + "}]"))
+		case "/v1/repositories/foo/volumes/vol":
+			w.Write([]byte("{\"name\":\"vol\",\"config\":" + config + "}"))
+		default:
+			w.WriteHeader(http.StatusNoContent)
+		}
+	})
+}
+
+func TestMountpointInvalid(t *testing.T) {
+	tests := map[string]string{
+		"{}":                           "volume foo/vol has no mountpoint",
+		"{\"mountpoint\":5}":           "volume foo/vol has invalid mountpoint '5'",
+		"{\"mountpoint\":\"vol\"}":     "volume foo/vol has invalid mountpoint 'vol', must be an absolute path",
+		"{\"mountpoint\":\"/a/../b\"}": "volume foo/vol has invalid mountpoint '/a/../b', must be an absolute path",
+	}
+	for config, message := range tests {
+		f, teardown := testForwarder(mountpointHandler(config))
+
+		assert.Equal(t, message, f.GetVolume(context.Background(), VolumeRequest{Name: "foo/vol"}).Err)
+		assert.Equal(t, message, f.GetPath(context.Background(), VolumeRequest{Name: "foo/vol"}).Err)
+		assert.Equal(t, message, f.MountVolume(context.Background(), MountVolumeRequest{Name: "foo/vol", ID: "a"}).Err)
+
+		resp := f.ListVolumes(context.Background())
+		if assert.Empty(t, resp.Err) && assert.Len(t, resp.Volumes, 1) {
+			assert.Equal(t, "foo/vol", resp.Volumes[0].Name)
+			assert.Empty(t, resp.Volumes[0].Mountpoint)
+		}
+
+		teardown()
+	}
+}
+
+func TestMountpointCheck(t *testing.T) {
+	dir, cleanup := testStateDir(t)
+	defer cleanup()
+
+	config := DefaultConfig()
+	config.CheckMountpoints = true
+	f, teardown := testForwarderWithConfig(mountpointHandler("{\"mountpoint\":\""+dir+"\"}"), config)
+	defer teardown()
+
+	assert.Equal(t, dir, f.GetPath(context.Background(), VolumeRequest{Name: "foo/vol"}).Mountpoint)
+	assert.Equal(t, dir, f.MountVolume(context.Background(), MountVolumeRequest{Name: "foo/vol", ID: "a"}).Mountpoint)
+}
+
+func TestMountpointCheckMissing(t *testing.T) {
+	dir, cleanup := testStateDir(t)
+	defer cleanup()
+	missing := filepath.Join(dir, "missing")
+
+	config := DefaultConfig()
+	config.CheckMountpoints = true
+	f, teardown := testForwarderWithConfig(mountpointHandler("{\"mountpoint\":\""+missing+"\"}"), config)
+	defer teardown()
+
+	assert.Contains(t, f.GetPath(context.Background(), VolumeRequest{Name: "foo/vol"}).Err, "is not accessible")
+	assert.Contains(t, f.MountVolume(context.Background(), MountVolumeRequest{Name: "foo/vol", ID: "a"}).Err,
+		"is not accessible")
+	assert.Equal(t, 0, f.(forwarder).mounts.count("foo", "vol"))
+}
+
+func TestMountpointCheckFailsDuplicateMount(t *testing.T) {
+	dir, cleanup := testStateDir(t)
+	defer cleanup()
+	mountpoint := filepath.Join(dir, "vol")
+	if err := os.Mkdir(mountpoint, 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	deactivated := false
+	handler := mountpointHandler("{\"mountpoint\":\"" + mountpoint + "\"}")
+	config := DefaultConfig()
+	config.CheckMountpoints = true
+	f, teardown := testForwarderWithConfig(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.RequestURI == "/v1/repositories/foo/volumes/vol/deactivate" {
+			deactivated = true
+		}
+		handler.ServeHTTP(w, r)
+	}), config)
+	defer teardown()
+
+	request := MountVolumeRequest{Name: "foo/vol", ID: "a"}
+	assert.Equal(t, mountpoint, f.MountVolume(context.Background(), request).Mountpoint)
+	os.Remove(mountpoint)
+
+	// The ID is still in use by the first mount, so the failed check must not deactivate the volume under it
+	assert.Contains(t, f.MountVolume(context.Background(), request).Err, "is not accessible")
+	assert.Equal(t, 1, f.(forwarder).mounts.count("foo", "vol"))
+	assert.False(t, deactivated)
+}
+
+func TestPathRewrite(t *testing.T) {
+	r, err := newPathRewriter([]PathRewrite{
+		{From: "/var/lib/titan", To: "/host/titan"},
+		{From: "/var/lib/titan/data", To: "/data"},
+		{From: "/var", To: "/other"},
+	}, "")
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	tests := map[string]string{
+		"/var/lib/titan/mnt/vol":  "/host/titan/mnt/vol",
+		"/var/lib/titan":          "/host/titan",
+		"/var/lib/titan/data/vol": "/data/vol",
+		"/var/lib/titanic":        "/other/lib/titanic",
+		"/vol":                    "/vol",
+	}
+	for from, to := range tests {
+		path, err := r.translate(from)
+		if assert.NoError(t, err) {
+			assert.Equal(t, to, path)
+		}
+	}
+}
+
+func TestPathRewriteRoot(t *testing.T) {
+	r, err := newPathRewriter([]PathRewrite{{From: "/var/lib/titan", To: "/host/titan"}}, "/host")
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	path, err := r.translate("/var/lib/titan/vol")
+	if assert.NoError(t, err) {
+		assert.Equal(t, "/host/titan/vol", path)
+	}
+
+	_, err = r.translate("/var/lib/other/vol")
+	if assert.Error(t, err) {
+		assert.Equal(t, "mountpoint /var/lib/other/vol is outside of the allowed root /host", err.Error())
+	}
+
+	_, err = r.translate("/hostile")
+	assert.Error(t, err)
+}
+
+func TestPathRewriteInvalid(t *testing.T) {
+	_, err := newPathRewriter([]PathRewrite{{From: "relative", To: "/host"}}, "")
+	assert.Error(t, err)
+	_, err = newPathRewriter([]PathRewrite{{From: "/a", To: "/b/../c"}}, "")
+	assert.Error(t, err)
+	_, err = newPathRewriter(nil, "root")
+	assert.Error(t, err)
+}
+
+func TestPathRewriteForwarder(t *testing.T) {
+	config := DefaultConfig()
+	config.PathRewrites = []PathRewrite{{From: "/var/lib/titan", To: "/host/titan"}}
+	config.MountRoot = "/host"
+	f, teardown := testForwarderWithConfig(mountpointHandler("{\"mountpoint\":\"/var/lib/titan/vol\"}"), config)
+	defer teardown()
+
+	assert.Equal(t, "/host/titan/vol", f.GetPath(context.Background(), VolumeRequest{Name: "foo/vol"}).Mountpoint)
+	assert.Equal(t, "/host/titan/vol",
+		f.GetVolume(context.Background(), VolumeRequest{Name: "foo/vol"}).Volume.Mountpoint)
+	assert.Equal(t, "/host/titan/vol", f.ListVolumes(context.Background()).Volumes[0].Mountpoint)
+	assert.Equal(t, "/host/titan/vol",
+		f.MountVolume(context.Background(), MountVolumeRequest{Name: "foo/vol", ID: "a"}).Mountpoint)
+}
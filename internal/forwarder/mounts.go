@@ -0,0 +1,200 @@
+/*
+ * Copyright The Titan Project Contributors.
+ */
+
+package forwarder
+
+import (
+	"fmt"
+	"github.com/titan-data/titan-docker-proxy/internal/logging"
+	"sync"
+	"time"
+)
+
+/*
+ * Docker issues a separate mount request for every container that uses a volume, each identified by a unique mount
+ * ID, and a matching unmount request when the container stops. Titan only has a single notion of an active volume, so
+ * the mount table reference counts those IDs: the volume is activated when the first ID arrives and deactivated only
+ * once the last ID is gone. Requests for IDs we already know about (or have never seen) are treated idempotently.
+ * If a state store is configured, the table is loaded from it at startup and written back after every change.
+ *
+ * The table's own lock only protects the table itself, and isn't held while calling titan-server. Callers must hold
+ * the volume's lock (see volumeLocks) when mounting or unmounting it, so that the table can't change underneath them.
+ */
+type mountTable struct {
+	lock   sync.Mutex
+	mounts map[string]*mountRecord
+	store  *stateStore
+	log    *logging.Logger
+}
+
+type mountRecord struct {
+	Repository string               `json:"repository"`
+	Volume     string               `json:"volume"`
+	Activated  time.Time            `json:"activated"`
+	IDs        map[string]time.Time `json:"ids"`
+}
+
+func newMountTable(store *stateStore, log *logging.Logger) (*mountTable, error) {
+	t := &mountTable{
+		mounts: map[string]*mountRecord{},
+		store:  store,
+		log:    log,
+	}
+	if store != nil {
+		mounts, err := store.load()
+		if err != nil {
+			return nil, err
+		}
+		t.mounts = mounts
+	}
+	return t, nil
+}
+
+/*
+ * Persists the table, if a store is configured. Must be called with the lock held. The volume has already been
+ * (de)activated by the time we get here, so failing the docker request would only leave docker and titan out of sync;
+ * instead we log the failure and carry on.
+ */
+func (t *mountTable) save() {
+	if t.store == nil {
+		return
+	}
+	if err := t.store.save(t.mounts); err != nil {
+		t.log.Error("unable to save mount state", logging.Error(err))
+	}
+}
+
+/*
+ * Persists the table, if a store is configured, returning any failure rather than logging it.
+ */
+func (t *mountTable) flush() error {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	if t.store == nil {
+		return nil
+	}
+	return t.store.save(t.mounts)
+}
+
+func mountKey(repo string, volume string) string {
+	return fmt.Sprintf("%s/%s", repo, volume)
+}
+
+/*
+ * Records a mount ID against the given volume, returning whether it was added, as opposed to already being recorded
+ * by an earlier mount. The activate function is invoked only if this is the first ID for the volume, and the ID is
+ * only recorded if activation succeeds.
+ */
+func (t *mountTable) mount(repo string, volume string, id string, activate func() error) (bool, error) {
+	key := mountKey(repo, volume)
+	t.lock.Lock()
+	record, ok := t.mounts[key]
+	if ok {
+		if _, mounted := record.IDs[id]; mounted {
+			t.lock.Unlock()
+			return false, nil
+		}
+	}
+	t.lock.Unlock()
+
+	now := time.Now().UTC()
+	if !ok || len(record.IDs) == 0 {
+		if err := activate(); err != nil {
+			return false, err
+		}
+		record = &mountRecord{Repository: repo, Volume: volume, Activated: now, IDs: map[string]time.Time{}}
+	}
+
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	t.mounts[key] = record
+	record.IDs[id] = now
+	t.save()
+	return true, nil
+}
+
+/*
+ * Removes a mount ID from the given volume. The deactivate function is invoked only when no other IDs remain. If we
+ * know nothing about the volume (for example, because it was mounted outside of the proxy), we still deactivate it so
+ * that repeated unmounts behave the same way. The ID is only forgotten if deactivation succeeds, so that docker can
+ * retry a failed unmount.
+ */
+func (t *mountTable) unmount(repo string, volume string, id string, deactivate func() error) error {
+	key := mountKey(repo, volume)
+	t.lock.Lock()
+	record, ok := t.mounts[key]
+	if ok {
+		remaining := len(record.IDs)
+		if _, mounted := record.IDs[id]; mounted {
+			remaining--
+		}
+		if remaining > 0 {
+			delete(record.IDs, id)
+			t.save()
+			t.lock.Unlock()
+			return nil
+		}
+	}
+	t.lock.Unlock()
+
+	if err := deactivate(); err != nil {
+		return err
+	}
+
+	if ok {
+		t.lock.Lock()
+		defer t.lock.Unlock()
+		delete(t.mounts, key)
+		t.save()
+	}
+	return nil
+}
+
+/*
+ * Forgets everything about a volume, used when the volume is removed.
+ */
+func (t *mountTable) remove(repo string, volume string) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	key := mountKey(repo, volume)
+	if _, ok := t.mounts[key]; ok {
+		delete(t.mounts, key)
+		t.save()
+	}
+}
+
+/*
+ * Returns a copy of every mount record.
+ */
+func (t *mountTable) records() []mountRecord {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	ret := []mountRecord{}
+	for _, record := range t.mounts {
+		ids := map[string]time.Time{}
+		for id, mounted := range record.IDs {
+			ids[id] = mounted
+		}
+		copied := *record
+		copied.IDs = ids
+		ret = append(ret, copied)
+	}
+	return ret
+}
+
+/*
+ * Returns the number of mount IDs currently holding the given volume.
+ */
+func (t *mountTable) count(repo string, volume string) int {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	if record, ok := t.mounts[mountKey(repo, volume)]; ok {
+		return len(record.IDs)
+	}
+	return 0
+}
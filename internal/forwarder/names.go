@@ -0,0 +1,239 @@
+/*
+ * Copyright The Titan Project Contributors.
+ */
+
+package forwarder
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+/*
+ * Docker only has a flat namespace of volume names, while titan volumes live within repositories. A NameResolver is
+ * the single place that maps between the two, and must round-trip: Format() of the result of a successful Parse()
+ * must give back a name that parses to the same repository and volume.
+ */
+type NameResolver interface {
+	Parse(name string) (repository string, volume string, err error)
+	Format(repository string, volume string) string
+}
+
+/*
+ * Implemented by resolvers that have more than one way to name a volume, returning each of them, most preferred
+ * first. Format() gives the first that parses back to the same volume.
+ */
+type nameFormatter interface {
+	formats(repository string, volume string) []string
+}
+
+/*
+ * Returns the name for a volume that parses back to it, or an error if the resolver has no such name, as with a
+ * volume whose name contains the separator.
+ */
+func formatName(names NameResolver, repo string, volume string) (string, error) {
+	name := names.Format(repo, volume)
+	if !parsesTo(names, name, repo, volume) {
+		return "", fmt.Errorf("volume '%s' in repository '%s' has no unambiguous name", volume, repo)
+	}
+	return name, nil
+}
+
+/*
+ * Picks the first of the candidate names that parses back to the volume, or the last if none do.
+ */
+func firstRoundTrip(names NameResolver, repo string, volume string, candidates []string) string {
+	for _, name := range candidates {
+		if parsesTo(names, name, repo, volume) {
+			return name
+		}
+	}
+	return candidates[len(candidates)-1]
+}
+
+func parsesTo(names NameResolver, name string, repo string, volume string) bool {
+	parsedRepo, parsedVolume, err := names.Parse(name)
+	return err == nil && parsedRepo == repo && parsedVolume == volume
+}
+
+const (
+	// <repository>/<volume>
+	NamingSlash = "slash"
+	// <repository><separator><volume>, with a configurable separator
+	NamingSeparator = "separator"
+	// <prefix><volume>, with a table of prefixes mapping to repositories
+	NamingPrefix = "prefix"
+)
+
+/*
+ * Configuration for the name resolver. Which fields apply depends on the scheme.
+ */
+type NamingConfig struct {
+	Scheme    string            `json:"scheme"`
+	Separator string            `json:"separator"`
+	Prefixes  map[string]string `json:"prefixes"`
+}
+
+/*
+ * Separates the repository and volume with a fixed string. Names without the separator are placed in the default
+ * repository, if one is set, and volumes in the default repository are formatted without it unless their own name
+ * contains the separator.
+ */
+type separatorResolver struct {
+	separator   string
+	defaultRepo string
+}
+
+func NewSeparatorResolver(separator string, defaultRepo string) (NameResolver, error) {
+	if separator == "" {
+		return nil, errors.New("volume name separator cannot be empty")
+	}
+	if strings.Contains(defaultRepo, separator) {
+		return nil, fmt.Errorf("invalid default repository '%s'", defaultRepo)
+	}
+	return separatorResolver{separator: separator, defaultRepo: defaultRepo}, nil
+}
+
+func (r separatorResolver) Parse(name string) (string, string, error) {
+	parts := strings.Split(name, r.separator)
+	if len(parts) == 2 && parts[0] != "" && parts[1] != "" {
+		return parts[0], parts[1], nil
+	}
+	if len(parts) == 1 && name != "" && r.defaultRepo != "" {
+		return r.defaultRepo, name, nil
+	}
+	return "", "", fmt.Errorf("volume name must be of the form <repository>%s<volume>", r.separator)
+}
+
+func (r separatorResolver) Format(repo string, volume string) string {
+	return firstRoundTrip(r, repo, volume, r.formats(repo, volume))
+}
+
+func (r separatorResolver) formats(repo string, volume string) []string {
+	if repo == r.defaultRepo {
+		return []string{volume, repo + r.separator + volume}
+	}
+	return []string{repo + r.separator + volume}
+}
+
+/*
+ * Maps volume name prefixes to repositories, so that "db-orders" can refer to the "orders" volume within the
+ * "databases" repository. The longest matching prefix wins. Names that don't match any prefix, and repositories
+ * that don't appear in the table, are handled by the fallback resolver. A name only matches a prefix if the rest of
+ * it is a plain volume name, so that with a prefix of "foo", "foo/vol" is still the "vol" volume in the "foo"
+ * repository rather than the "/vol" volume.
+ */
+type prefixResolver struct {
+	prefixes []string
+	byPrefix map[string]string
+	byRepo   map[string]string
+	fallback NameResolver
+}
+
+func NewPrefixResolver(prefixes map[string]string, fallback NameResolver) (NameResolver, error) {
+	r := prefixResolver{
+		prefixes: []string{},
+		byPrefix: map[string]string{},
+		byRepo:   map[string]string{},
+		fallback: fallback,
+	}
+	for prefix, repo := range prefixes {
+		if prefix == "" || repo == "" {
+			return nil, errors.New("volume name prefixes and repositories cannot be empty")
+		}
+		if other, ok := r.byRepo[repo]; ok {
+			return nil, fmt.Errorf("repository '%s' is mapped by both '%s' and '%s'", repo, other, prefix)
+		}
+		r.prefixes = append(r.prefixes, prefix)
+		r.byPrefix[prefix] = repo
+		r.byRepo[repo] = prefix
+	}
+	sort.Slice(r.prefixes, func(i, j int) bool {
+		if len(r.prefixes[i]) != len(r.prefixes[j]) {
+			return len(r.prefixes[i]) > len(r.prefixes[j])
+		}
+		return r.prefixes[i] < r.prefixes[j]
+	})
+	return r, nil
+}
+
+func (r prefixResolver) Parse(name string) (string, string, error) {
+	for _, prefix := range r.prefixes {
+		if strings.HasPrefix(name, prefix) && r.isVolumeName(name[len(prefix):]) {
+			return r.byPrefix[prefix], name[len(prefix):], nil
+		}
+	}
+	return r.fallback.Parse(name)
+}
+
+/*
+ * Volume names can never contain "/", and names containing the fallback's separator belong to the fallback.
+ */
+func (r prefixResolver) isVolumeName(volume string) bool {
+	if volume == "" || strings.Contains(volume, "/") {
+		return false
+	}
+	if fallback, ok := r.fallback.(separatorResolver); ok && strings.Contains(volume, fallback.separator) {
+		return false
+	}
+	return true
+}
+
+/*
+ * Names from the fallback may look like they have a prefix, as "db-orders" in the default repository does with a
+ * prefix of "db-", so the fallback's longer forms are used when its preferred one would be taken for another volume.
+ */
+func (r prefixResolver) Format(repo string, volume string) string {
+	return firstRoundTrip(r, repo, volume, r.formats(repo, volume))
+}
+
+func (r prefixResolver) formats(repo string, volume string) []string {
+	candidates := []string{}
+	if prefix, ok := r.byRepo[repo]; ok {
+		candidates = append(candidates, prefix+volume)
+	}
+	if fallback, ok := r.fallback.(nameFormatter); ok {
+		return append(candidates, fallback.formats(repo, volume)...)
+	}
+	return append(candidates, r.fallback.Format(repo, volume))
+}
+
+/*
+ * Returns the name that Format() gives for the volume a name refers to, so that different names for the same volume
+ * (such as "vol" and "foo/vol" with a default repository of "foo") share cache entries and in-flight calls. Names
+ * that can't be parsed are returned as they are.
+ */
+func canonicalName(names NameResolver, name string) string {
+	repo, volume, err := names.Parse(name)
+	if err != nil {
+		return name
+	}
+	return names.Format(repo, volume)
+}
+
+/*
+ * Builds the resolver selected by the configuration. The default repository applies to the slash and separator
+ * schemes, as well as the slash fallback of the prefix scheme.
+ */
+func newNameResolver(config Config) (NameResolver, error) {
+	if config.NameResolver != nil {
+		return config.NameResolver, nil
+	}
+
+	naming := config.Naming
+	switch naming.Scheme {
+	case "", NamingSlash:
+		return NewSeparatorResolver("/", config.DefaultRepository)
+	case NamingSeparator:
+		return NewSeparatorResolver(naming.Separator, config.DefaultRepository)
+	case NamingPrefix:
+		fallback, err := NewSeparatorResolver("/", config.DefaultRepository)
+		if err != nil {
+			return nil, err
+		}
+		return NewPrefixResolver(naming.Prefixes, fallback)
+	}
+	return nil, fmt.Errorf("invalid volume naming scheme '%s'", naming.Scheme)
+}
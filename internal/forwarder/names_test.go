@@ -0,0 +1,193 @@
+/*
+ * Copyright The Titan Project Contributors.
+ */
+
+package forwarder
+
+import (
+	"bytes"
+	"context"
+	"github.com/stretchr/testify/assert"
+	"github.com/titan-data/titan-docker-proxy/internal/logging"
+	"net/http"
+	"testing"
+)
+
+func assertRoundTrip(t *testing.T, r NameResolver, name string, repo string, volume string) {
+	parsedRepo, parsedVolume, err := r.Parse(name)
+	if assert.NoError(t, err) {
+		assert.Equal(t, repo, parsedRepo)
+		assert.Equal(t, volume, parsedVolume)
+		assert.Equal(t, name, r.Format(parsedRepo, parsedVolume))
+	}
+}
+
+func TestSlashResolver(t *testing.T) {
+	r, _ := NewSeparatorResolver("/", "")
+	assertRoundTrip(t, r, "foo/vol", "foo", "vol")
+
+	for _, name := range []string{"vol", "", "/vol", "foo/", "a/b/c"} {
+		_, _, err := r.Parse(name)
+		if assert.Error(t, err) {
+			assert.Equal(t, "volume name must be of the form <repository>/<volume>", err.Error())
+		}
+	}
+}
+
+func TestSlashResolverDefaultRepository(t *testing.T) {
+	r, _ := NewSeparatorResolver("/", "default")
+	assertRoundTrip(t, r, "foo/vol", "foo", "vol")
+	assertRoundTrip(t, r, "vol", "default", "vol")
+	assert.Equal(t, "vol", r.Format("default", "vol"))
+}
+
+func TestSeparatorResolver(t *testing.T) {
+	r, _ := NewSeparatorResolver("__", "")
+	assertRoundTrip(t, r, "foo__vol", "foo", "vol")
+
+	_, _, err := r.Parse("foo/vol")
+	if assert.Error(t, err) {
+		assert.Equal(t, "volume name must be of the form <repository>__<volume>", err.Error())
+	}
+}
+
+func TestSeparatorResolverVolumeWithSeparator(t *testing.T) {
+	r, _ := NewSeparatorResolver("__", "main")
+	_, err := formatName(r, "main", "a__b")
+	assert.EqualError(t, err, "volume 'a__b' in repository 'main' has no unambiguous name")
+	_, err = formatName(r, "x", "a__b")
+	assert.EqualError(t, err, "volume 'a__b' in repository 'x' has no unambiguous name")
+
+	name, err := formatName(r, "main", "vol")
+	assert.NoError(t, err)
+	assert.Equal(t, "vol", name)
+}
+
+func TestSeparatorResolverBadConfig(t *testing.T) {
+	_, err := NewSeparatorResolver("", "")
+	assert.Error(t, err)
+	_, err = NewSeparatorResolver("/", "foo/bar")
+	assert.Error(t, err)
+}
+
+func TestPrefixResolver(t *testing.T) {
+	fallback, _ := NewSeparatorResolver("/", "")
+	r, err := NewPrefixResolver(map[string]string{"db-": "databases", "db-cache-": "caches"}, fallback)
+	if !assert.NoError(t, err) {
+		return
+	}
+	assertRoundTrip(t, r, "db-orders", "databases", "orders")
+	assertRoundTrip(t, r, "db-cache-redis", "caches", "redis")
+	assertRoundTrip(t, r, "foo/vol", "foo", "vol")
+
+	_, _, err = r.Parse("db-")
+	assert.Error(t, err)
+}
+
+func TestPrefixResolverFallbackName(t *testing.T) {
+	fallback, _ := NewSeparatorResolver("/", "")
+	r, err := NewPrefixResolver(map[string]string{"foo": "bar"}, fallback)
+	if !assert.NoError(t, err) {
+		return
+	}
+	assertRoundTrip(t, r, "foovol", "bar", "vol")
+	assertRoundTrip(t, r, "foo/vol", "foo", "vol")
+	assertRoundTrip(t, r, "foo/foo", "foo", "foo")
+}
+
+func TestPrefixResolverSeparatorFallback(t *testing.T) {
+	fallback, _ := NewSeparatorResolver(".", "")
+	r, err := NewPrefixResolver(map[string]string{"db-": "databases"}, fallback)
+	if !assert.NoError(t, err) {
+		return
+	}
+	assertRoundTrip(t, r, "db-orders", "databases", "orders")
+	assertRoundTrip(t, r, "db-x.vol", "db-x", "vol")
+}
+
+func TestPrefixResolverDefaultRepository(t *testing.T) {
+	fallback, _ := NewSeparatorResolver("/", "main")
+	r, err := NewPrefixResolver(map[string]string{"db-": "databases"}, fallback)
+	if !assert.NoError(t, err) {
+		return
+	}
+	assertRoundTrip(t, r, "db-orders", "databases", "orders")
+	assertRoundTrip(t, r, "main/db-orders", "main", "db-orders")
+	assertRoundTrip(t, r, "vol", "main", "vol")
+}
+
+func TestPrefixResolverDuplicateRepository(t *testing.T) {
+	fallback, _ := NewSeparatorResolver("/", "")
+	_, err := NewPrefixResolver(map[string]string{"a-": "repo", "b-": "repo"}, fallback)
+	assert.Error(t, err)
+}
+
+func TestNamingSchemeInvalid(t *testing.T) {
+	config := DefaultConfig()
+	config.Naming.Scheme = "bogus"
+	_, err := NewWithConfig(config)
+	assert.Error(t, err)
+}
+
+func TestListVolumesSeparatorScheme(t *testing.T) {
+	h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		if r.RequestURI == "/v1/repositories" {
+			w.Write([]byte("[{\"name\":\"foo\",\"properties\":{}}]"))
+		} else {
+			w.Write([]byte("[{\"name\":\"v0\",\"config\":{\"mountpoint\":\"/v0\"}}]"))
+		}
+	})
+	config := DefaultConfig()
+	config.Naming = NamingConfig{Scheme: NamingSeparator, Separator: "__"}
+	f, teardown := testForwarderWithConfig(h, config)
+	defer teardown()
+
+	resp := f.ListVolumes(context.Background())
+	if assert.Empty(t, resp.Err) && assert.Len(t, resp.Volumes, 1) {
+		assert.Equal(t, "foo__v0", resp.Volumes[0].Name)
+	}
+}
+
+func TestGetVolumePrefixScheme(t *testing.T) {
+	h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		assert.Equal(t, r.RequestURI, "/v1/repositories/databases/volumes/orders")
+		w.Write([]byte("{\"name\":\"orders\",\"config\":{\"mountpoint\":\"/orders\"}}"))
+	})
+	config := DefaultConfig()
+	config.Naming = NamingConfig{Scheme: NamingPrefix, Prefixes: map[string]string{"db-": "databases"}}
+	f, teardown := testForwarderWithConfig(h, config)
+	defer teardown()
+
+	resp := f.GetVolume(context.Background(), VolumeRequest{Name: "db-orders"})
+	if assert.Empty(t, resp.Err) {
+		assert.Equal(t, "db-orders", resp.Volume.Name)
+	}
+}
+
+func TestListVolumesSkipsAmbiguousNames(t *testing.T) {
+	h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		if r.RequestURI == "/v1/repositories" {
+			w.Write([]byte("[{\"name\":\"main\",\"properties\":{}}]"))
+		} else {
+			w.Write([]byte("[{\"name\":\"a__b\",\"config\":{\"mountpoint\":\"/a__b\"}}," +
+				"{\"name\":\"v0\",\"config\":{\"mountpoint\":\"/v0\"}}]"))
+		}
+	})
+	var buf bytes.Buffer
+	config := DefaultConfig()
+	config.DefaultRepository = "main"
+	config.Naming = NamingConfig{Scheme: NamingSeparator, Separator: "__"}
+	config.Logger = logging.New(&buf, logging.LevelWarn, logging.FormatText)
+	f, teardown := testForwarderWithConfig(h, config)
+	defer teardown()
+
+	resp := f.ListVolumes(context.Background())
+	if assert.Empty(t, resp.Err) && assert.Len(t, resp.Volumes, 1) {
+		assert.Equal(t, "v0", resp.Volumes[0].Name)
+	}
+	assert.Contains(t, buf.String(), "msg=\"not listing volume, as docker would be unable to refer to it\" "+
+		"volume=main/a__b ")
+}
@@ -0,0 +1,154 @@
+/*
+ * Copyright The Titan Project Contributors.
+ */
+
+package forwarder
+
+import (
+	"context"
+	"fmt"
+	"github.com/titan-data/titan-docker-proxy/internal/logging"
+)
+
+/*
+ * After a crash, titan-server and the proxy can disagree about which volumes are in use: titan may have volumes
+ * activated that no container is using, or the proxy may hold mount records for volumes that titan has since
+ * deactivated (or deleted). Reconciliation walks every volume known to titan and compares it with the mount table.
+ * Titan does not report whether a volume is active, but activation and deactivation are both idempotent, so we simply
+ * re-issue whichever one the mount table implies, subject to the configured policy. Records for volumes that no longer
+ * exist are dropped, since there is nothing left to unmount, unless the policy is to only log. Every correction is
+ * logged, including those the policy skips.
+ */
+
+type ReconcilePolicy string
+
+const (
+	// Only log the corrections that would have been made
+	ReconcileNone ReconcilePolicy = "none"
+	// Reactivate volumes that have mount records
+	ReconcileReactivate ReconcilePolicy = "reactivate"
+	// Deactivate volumes that have no mount records
+	ReconcileDeactivate ReconcilePolicy = "deactivate"
+	// Both reactivate and deactivate
+	ReconcileFull ReconcilePolicy = "full"
+)
+
+/*
+ * Implemented by forwarders that can reconcile their state with titan-server. This is run at startup, and can be
+ * triggered on demand by the command.
+ */
+type Reconciler interface {
+	Reconcile(ctx context.Context) error
+}
+
+func (policy ReconcilePolicy) validate() error {
+	switch policy {
+	case ReconcileNone, ReconcileReactivate, ReconcileDeactivate, ReconcileFull:
+		return nil
+	}
+	return fmt.Errorf("invalid reconcile policy '%s'", policy)
+}
+
+func (policy ReconcilePolicy) reactivate() bool {
+	return policy == ReconcileReactivate || policy == ReconcileFull
+}
+
+func (policy ReconcilePolicy) deactivate() bool {
+	return policy == ReconcileDeactivate || policy == ReconcileFull
+}
+
+/*
+ * Runs a single reconciliation pass. Failures to correct an individual volume are logged and do not stop the pass,
+ * but are reflected in the returned error.
+ */
+func (p forwarder) Reconcile(ctx context.Context) error {
+	repositories, _, err := p.client.ListRepositories(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to list repositories: %s", getErrorString(err))
+	}
+
+	known := map[string]bool{}
+	failures := 0
+	for _, repo := range repositories {
+		volumes, _, err := p.client.ListVolumes(ctx, repo.Name)
+		if err != nil {
+			return fmt.Errorf("failed to list volumes for %s: %s", repo.Name, getErrorString(err))
+		}
+
+		for _, vol := range volumes {
+			known[mountKey(repo.Name, vol.Name)] = true
+			err = p.reconcileVolume(ctx, repo.Name, vol.Name)
+			if err != nil {
+				p.log.Warn("reconcile: failed to correct volume", logging.Volume(mountKey(repo.Name, vol.Name)),
+					errorField(err))
+				failures++
+			}
+		}
+	}
+
+	for _, record := range p.mounts.records() {
+		if !known[mountKey(record.Repository, record.Volume)] {
+			err = p.forgetVolume(ctx, record)
+			if err != nil {
+				p.log.Warn("reconcile: failed to forget volume",
+					logging.Volume(mountKey(record.Repository, record.Volume)), errorField(err))
+				failures++
+			}
+		}
+	}
+
+	if failures != 0 {
+		return fmt.Errorf("failed to reconcile %d volume(s)", failures)
+	}
+	return nil
+}
+
+func (p forwarder) forgetVolume(ctx context.Context, record mountRecord) error {
+	unlock, err := p.locks.acquire(ctx, volumeLockKey(record.Repository, record.Volume))
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	if p.policy == ReconcileNone {
+		p.log.Info("reconcile: volume no longer exists, not forgetting its mounts due to policy",
+			logging.Volume(mountKey(record.Repository, record.Volume)), logging.F("mounts", len(record.IDs)),
+			logging.F("policy", p.policy))
+		return nil
+	}
+	p.log.Info("reconcile: forgetting mounts of volume that no longer exists",
+		logging.Volume(mountKey(record.Repository, record.Volume)), logging.F("mounts", len(record.IDs)))
+	p.mounts.remove(record.Repository, record.Volume)
+	return nil
+}
+
+/*
+ * Corrects a single volume, holding its lock so that it can't be mounted or unmounted in the meantime.
+ */
+func (p forwarder) reconcileVolume(ctx context.Context, repoName string, volumeName string) error {
+	unlock, err := p.locks.acquire(ctx, volumeLockKey(repoName, volumeName))
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	if p.mounts.count(repoName, volumeName) != 0 {
+		if !p.policy.reactivate() {
+			p.log.Info("reconcile: volume is mounted, not reactivating due to policy",
+				logging.Volume(mountKey(repoName, volumeName)), logging.F("policy", p.policy))
+			return nil
+		}
+		p.log.Info("reconcile: reactivating volume", logging.Volume(mountKey(repoName, volumeName)))
+		_, err = p.client.ActivateVolume(ctx, repoName, volumeName)
+		return err
+	}
+
+	if !p.policy.deactivate() {
+		p.log.Info("reconcile: volume is not mounted, not deactivating due to policy",
+			logging.Volume(mountKey(repoName, volumeName)), logging.F("policy", p.policy))
+		return nil
+	}
+	p.log.Info("reconcile: deactivating unmounted volume", logging.Volume(mountKey(repoName, volumeName)))
+	_, err = p.client.DeactivateVolume(ctx, repoName, volumeName)
+	return err
+}
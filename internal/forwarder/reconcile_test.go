@@ -0,0 +1,113 @@
+/*
+ * Copyright The Titan Project Contributors.
+ */
+
+package forwarder
+
+import (
+	"bytes"
+	"context"
+	"github.com/stretchr/testify/assert"
+	"github.com/titan-data/titan-docker-proxy/internal/logging"
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+)
+
+type reconcileServer struct {
+	lock     sync.Mutex
+	requests []string
+}
+
+func (s *reconcileServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	switch r.RequestURI {
+	case "/v1/repositories":
+		w.Write([]byte("[{\"name\":\"foo\",\"properties\":{}}]"))
+	case "/v1/repositories/foo/volumes":
+		w.Write([]byte("[{\"name\":\"v0\",\"config\":{\"mountpoint\":\"/v0\"}}," +
+			"{\"name\":\"v1\",\"config\":{\"mountpoint\":\"/v1\"}}]"))
+	default:
+		s.lock.Lock()
+		s.requests = append(s.requests, r.RequestURI)
+		s.lock.Unlock()
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+func testReconcile(t *testing.T, policy ReconcilePolicy) ([]string, *mountTable) {
+	return testReconcileWithLogger(t, policy, logging.Discard())
+}
+
+func testReconcileWithLogger(t *testing.T, policy ReconcilePolicy, log *logging.Logger) ([]string, *mountTable) {
+	s := &reconcileServer{}
+	config := DefaultConfig()
+	config.ReconcilePolicy = policy
+	config.Logger = log
+	f, teardown := testForwarderWithConfig(s, config)
+	defer teardown()
+
+	mounts := f.(forwarder).mounts
+	now := time.Now()
+	mounts.mounts["foo/v0"] = &mountRecord{Repository: "foo", Volume: "v0", IDs: map[string]time.Time{"a": now}}
+	mounts.mounts["foo/gone"] = &mountRecord{Repository: "foo", Volume: "gone", IDs: map[string]time.Time{"b": now}}
+
+	assert.NoError(t, f.(Reconciler).Reconcile(context.Background()))
+	return s.requests, mounts
+}
+
+func TestReconcileNone(t *testing.T) {
+	var buf bytes.Buffer
+	requests, mounts := testReconcileWithLogger(t, ReconcileNone,
+		logging.New(&buf, logging.LevelInfo, logging.FormatText))
+	assert.Empty(t, requests)
+	assert.Len(t, mounts.records(), 2)
+
+	logged := buf.String()
+	assert.Contains(t, logged, "msg=\"reconcile: volume is mounted, not reactivating due to policy\" volume=foo/v0 ")
+	assert.Contains(t, logged, "msg=\"reconcile: volume is not mounted, not deactivating due to policy\" "+
+		"volume=foo/v1 ")
+	assert.Contains(t, logged, "msg=\"reconcile: volume no longer exists, not forgetting its mounts due to policy\" "+
+		"volume=foo/gone ")
+}
+
+func TestReconcileReactivate(t *testing.T) {
+	requests, mounts := testReconcile(t, ReconcileReactivate)
+	assert.Equal(t, []string{"/v1/repositories/foo/volumes/v0/activate"}, requests)
+	assert.Len(t, mounts.records(), 1)
+	assert.Contains(t, mounts.mounts, "foo/v0")
+}
+
+func TestReconcileDeactivate(t *testing.T) {
+	requests, _ := testReconcile(t, ReconcileDeactivate)
+	assert.Equal(t, []string{"/v1/repositories/foo/volumes/v1/deactivate"}, requests)
+}
+
+func TestReconcileFull(t *testing.T) {
+	requests, _ := testReconcile(t, ReconcileFull)
+	assert.Equal(t, []string{"/v1/repositories/foo/volumes/v0/activate",
+		"/v1/repositories/foo/volumes/v1/deactivate"}, requests)
+}
+
+func TestReconcileListError(t *testing.T) {
+	h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte("{\"message\":\"server error\"}"))
+	})
+	f, teardown := testForwarder(h)
+	defer teardown()
+
+	err := f.(Reconciler).Reconcile(context.Background())
+	if assert.Error(t, err) {
+		assert.Equal(t, "failed to list repositories: server error", err.Error())
+	}
+}
+
+func TestReconcileBadPolicy(t *testing.T) {
+	config := DefaultConfig()
+	config.ReconcilePolicy = "bogus"
+	_, err := NewWithConfig(config)
+	assert.Error(t, err)
+}
@@ -0,0 +1,147 @@
+/*
+ * Copyright The Titan Project Contributors.
+ */
+
+package forwarder
+
+import (
+	"context"
+	"fmt"
+	"github.com/titan-data/titan-docker-proxy/internal/logging"
+	"math/rand"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+/*
+ * titan-server restarts (or is briefly unreachable) often enough that passing every failure straight back to docker
+ * makes container starts flaky. Calls that are safe to retry are retried on transient failures, meaning connection
+ * errors and 5xx responses, with exponential backoff and jitter. To keep a docker request from retrying indefinitely
+ * across many titan calls, each request also gets a retry budget that is shared by all of its calls.
+ */
+type RetryConfig struct {
+	// Maximum number of attempts for a single call, including the first. 1 disables retries.
+	MaxAttempts int `json:"maxAttempts"`
+	// Backoff before the first retry, doubling for each retry after that up to the maximum
+	InitialBackoff Duration `json:"initialBackoff"`
+	MaxBackoff     Duration `json:"maxBackoff"`
+	// Total number of retries allowed across all calls made on behalf of a single docker request
+	Budget int `json:"budget"`
+}
+
+func (c RetryConfig) validate() error {
+	if c.MaxAttempts < 1 {
+		return fmt.Errorf("retry attempts must be at least 1")
+	}
+	if c.InitialBackoff < 0 || c.MaxBackoff < c.InitialBackoff {
+		return fmt.Errorf("invalid retry backoff %s to %s", time.Duration(c.InitialBackoff),
+			time.Duration(c.MaxBackoff))
+	}
+	if c.Budget < 0 {
+		return fmt.Errorf("retry budget cannot be negative")
+	}
+	return nil
+}
+
+type retryBudgetKey struct{}
+
+type retryBudget struct {
+	remaining int32
+}
+
+func withRetryBudget(ctx context.Context, budget int) context.Context {
+	return context.WithValue(ctx, retryBudgetKey{}, &retryBudget{remaining: int32(budget)})
+}
+
+/*
+ * Takes one retry from the request's budget, if there is one. Contexts without a budget (such as reconciliation)
+ * are only limited by the maximum number of attempts.
+ */
+func takeRetry(ctx context.Context) bool {
+	budget, ok := ctx.Value(retryBudgetKey{}).(*retryBudget)
+	if !ok {
+		return true
+	}
+	return atomic.AddInt32(&budget.remaining, -1) >= 0
+}
+
+func isTransient(ctx context.Context, resp *http.Response, err error) bool {
+	if err == nil || ctx.Err() != nil {
+		return false
+	}
+	if resp == nil {
+		return true
+	}
+	return resp.StatusCode >= http.StatusInternalServerError
+}
+
+func (c RetryConfig) backoff(retry int) time.Duration {
+	backoff := time.Duration(c.InitialBackoff)
+	for i := 0; i < retry && backoff < time.Duration(c.MaxBackoff); i++ {
+		backoff *= 2
+	}
+	if backoff > time.Duration(c.MaxBackoff) {
+		backoff = time.Duration(c.MaxBackoff)
+	}
+	if backoff <= 0 {
+		return 0
+	}
+	// Jitter between half and all of the backoff, so that requests failing together don't retry together
+	return backoff/2 + time.Duration(rand.Int63n(int64(backoff/2)+1))
+}
+
+/*
+ * Invokes a titan-server call, retrying it if it's retryable and fails transiently. Each attempt must first be
+ * admitted by the limiter and then let through by the circuit breaker.
+ */
+func (c *titanClient) call(ctx context.Context, operation string, retryable bool,
+	fn func() (*http.Response, error)) (*http.Response, error) {
+	for attempt := 1; ; attempt++ {
+		release, err := c.limiter.acquire(ctx)
+		if err != nil {
+			return nil, err
+		}
+		probe, err := c.breaker.allow()
+		if err != nil {
+			release()
+			markUnreachable(ctx)
+			return nil, err
+		}
+
+		start := time.Now()
+		resp, err := fn()
+		release()
+		c.logCall(ctx, operation, attempt, time.Since(start), resp, err)
+		outcome := getCallOutcome(resp, err)
+		c.breaker.record(probe, outcome)
+		if outcome == callFailed {
+			markUnreachable(ctx)
+		}
+		if !retryable || attempt >= c.retry.MaxAttempts || !isTransient(ctx, resp, err) || !takeRetry(ctx) {
+			return resp, err
+		}
+
+		select {
+		case <-ctx.Done():
+			return resp, err
+		case <-time.After(c.retry.backoff(attempt - 1)):
+		}
+	}
+}
+
+func (c *titanClient) logCall(ctx context.Context, operation string, attempt int, duration time.Duration,
+	resp *http.Response, err error) {
+	if !c.log.Enabled(logging.LevelDebug) {
+		return
+	}
+	fields := []logging.Field{logging.F("operation", operation), logging.Endpoint(describeEndpoint(getEndpoint(ctx))),
+		logging.F("attempt", attempt), logging.Duration(duration)}
+	if resp != nil {
+		fields = append(fields, logging.StatusCode(resp.StatusCode))
+	}
+	if err != nil {
+		fields = append(fields, errorField(err))
+	}
+	c.log.Debug("titan-server call", fields...)
+}
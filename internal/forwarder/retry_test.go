@@ -0,0 +1,118 @@
+/*
+ * Copyright The Titan Project Contributors.
+ */
+
+package forwarder
+
+import (
+	"context"
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func retryConfig() Config {
+	config := DefaultConfig()
+	config.Retry.InitialBackoff = Duration(time.Millisecond)
+	config.Retry.MaxBackoff = Duration(5 * time.Millisecond)
+	return config
+}
+
+/*
+ * Fails the first n requests with the given status, and then succeeds.
+ */
+func flakyHandler(failures int32, status int, count *int32) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		if atomic.AddInt32(count, 1) <= failures {
+			w.WriteHeader(status)
+			w.Write([]byte("{\"message\":\"unavailable\"}"))
+			return
+		}
+		if r.Method == "POST" {
+			w.WriteHeader(http.StatusCreated)
+		}
+		w.Write([]byte("{\"name\":\"vol\",\"config\":{\"mountpoint\":\"/vol\"},\"properties\":{}}"))
+	})
+}
+
+func TestRetryTransientFailure(t *testing.T) {
+	var count int32
+	f, teardown := testForwarderWithConfig(flakyHandler(2, http.StatusServiceUnavailable, &count), retryConfig())
+	defer teardown()
+
+	resp := f.GetVolume(context.Background(), VolumeRequest{Name: "foo/vol"})
+	assert.Empty(t, resp.Err)
+	assert.Equal(t, int32(3), count)
+}
+
+func TestRetryMaxAttempts(t *testing.T) {
+	var count int32
+	f, teardown := testForwarderWithConfig(flakyHandler(10, http.StatusServiceUnavailable, &count), retryConfig())
+	defer teardown()
+
+	resp := f.GetVolume(context.Background(), VolumeRequest{Name: "foo/vol"})
+	assert.Equal(t, "unavailable", resp.Err)
+	assert.Equal(t, int32(4), count)
+}
+
+func TestRetryBudget(t *testing.T) {
+	var count int32
+	config := retryConfig()
+	config.Retry.Budget = 1
+	f, teardown := testForwarderWithConfig(flakyHandler(10, http.StatusServiceUnavailable, &count), config)
+	defer teardown()
+
+	resp := f.GetVolume(context.Background(), VolumeRequest{Name: "foo/vol"})
+	assert.Equal(t, "unavailable", resp.Err)
+	assert.Equal(t, int32(2), count)
+}
+
+func TestRetryPermanentFailure(t *testing.T) {
+	var count int32
+	f, teardown := testForwarderWithConfig(flakyHandler(1, http.StatusNotFound, &count), retryConfig())
+	defer teardown()
+
+	resp := f.GetVolume(context.Background(), VolumeRequest{Name: "foo/vol"})
+	assert.Equal(t, "unavailable", resp.Err)
+	assert.Equal(t, int32(1), count)
+}
+
+func TestRetryNotIdempotent(t *testing.T) {
+	var count int32
+	f, teardown := testForwarderWithConfig(flakyHandler(1, http.StatusServiceUnavailable, &count), retryConfig())
+	defer teardown()
+
+	resp := f.CreateVolume(context.Background(), CreateVolumeRequest{Name: "foo/vol"})
+	assert.Equal(t, "unavailable", resp.Err)
+	assert.Equal(t, int32(1), count)
+}
+
+func TestRetryConnectionRefused(t *testing.T) {
+	config := retryConfig()
+	config.Port = 1
+	f, err := NewWithConfig(config)
+	if assert.NoError(t, err) {
+		start := time.Now()
+		resp := f.GetVolume(context.Background(), VolumeRequest{Name: "foo/vol"})
+		assert.NotEmpty(t, resp.Err)
+		assert.True(t, time.Since(start) < time.Second)
+	}
+}
+
+func TestRetryBackoff(t *testing.T) {
+	config := RetryConfig{InitialBackoff: Duration(100 * time.Millisecond), MaxBackoff: Duration(time.Second)}
+	for retry, max := range []time.Duration{100, 200, 400, 800, 1000, 1000} {
+		backoff := config.backoff(retry)
+		assert.True(t, backoff >= max*time.Millisecond/2 && backoff <= max*time.Millisecond)
+	}
+}
+
+func TestRetryBadConfig(t *testing.T) {
+	config := DefaultConfig()
+	config.Retry.MaxAttempts = 0
+	_, err := NewWithConfig(config)
+	assert.Error(t, err)
+}
@@ -0,0 +1,128 @@
+/*
+ * Copyright The Titan Project Contributors.
+ */
+
+package forwarder
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+/*
+ * Docker will not replay mount requests when the proxy restarts, so the mount table is persisted to disk after every
+ * change and reloaded at startup. The file is a simple JSON document, and is always replaced atomically by writing a
+ * temporary file in the same directory and renaming it over the original.
+ */
+type stateStore struct {
+	path string
+}
+
+const stateVersion = 1
+
+type stateFile struct {
+	Version int            `json:"version"`
+	Mounts  []*mountRecord `json:"mounts"`
+}
+
+/*
+ * Implemented by forwarders that keep state which should be written out before the proxy exits.
+ */
+type Flusher interface {
+	Flush() error
+}
+
+/*
+ * Writes the mount table to the state store, if one is configured. The table is already saved after every change, so
+ * this only matters if one of those saves failed, but it is the last chance to do so before exiting.
+ */
+func (p forwarder) Flush() error {
+	return p.mounts.flush()
+}
+
+func newStateStore(path string) *stateStore {
+	return &stateStore{path: path}
+}
+
+/*
+ * Reads the mount records from disk. A missing file is not an error, as this is the case the first time the proxy
+ * is started.
+ */
+func (s *stateStore) load() (map[string]*mountRecord, error) {
+	mounts := map[string]*mountRecord{}
+
+	data, err := ioutil.ReadFile(s.path)
+	if os.IsNotExist(err) {
+		return mounts, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read state file %s: %w", s.path, err)
+	}
+
+	var state stateFile
+	if err = json.Unmarshal(data, &state); err != nil {
+		return nil, fmt.Errorf("failed to parse state file %s: %w", s.path, err)
+	}
+	if state.Version != stateVersion {
+		return nil, fmt.Errorf("unsupported state file version %d in %s", state.Version, s.path)
+	}
+
+	for _, record := range state.Mounts {
+		if record.IDs == nil {
+			continue
+		}
+		mounts[mountKey(record.Repository, record.Volume)] = record
+	}
+	return mounts, nil
+}
+
+/*
+ * Writes the given mount records to disk, replacing any previous contents.
+ */
+func (s *stateStore) save(mounts map[string]*mountRecord) error {
+	state := stateFile{
+		Version: stateVersion,
+		Mounts:  []*mountRecord{},
+	}
+	for _, record := range mounts {
+		state.Mounts = append(state.Mounts, record)
+	}
+	sort.Slice(state.Mounts, func(i, j int) bool {
+		return mountKey(state.Mounts[i].Repository, state.Mounts[i].Volume) <
+			mountKey(state.Mounts[j].Repository, state.Mounts[j].Volume)
+	})
+
+	data, err := json.MarshalIndent(state, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	dir := filepath.Dir(s.path)
+	if err = os.MkdirAll(dir, 0755); err != nil {
+		return fmt.Errorf("failed to create state directory %s: %w", dir, err)
+	}
+	tmp, err := ioutil.TempFile(dir, "."+filepath.Base(s.path)+".")
+	if err != nil {
+		return fmt.Errorf("failed to create state file in %s: %w", dir, err)
+	}
+	defer os.Remove(tmp.Name())
+
+	_, err = tmp.Write(data)
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), s.path)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to write state file %s: %w", s.path, err)
+	}
+	return nil
+}
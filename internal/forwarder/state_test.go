@@ -0,0 +1,154 @@
+/*
+ * Copyright The Titan Project Contributors.
+ */
+
+package forwarder
+
+import (
+	"context"
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func testStateDir(t *testing.T) (string, func()) {
+	dir, err := ioutil.TempDir("", "titan-docker-proxy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return dir, func() { os.RemoveAll(dir) }
+}
+
+func TestStateMissingFile(t *testing.T) {
+	dir, cleanup := testStateDir(t)
+	defer cleanup()
+
+	mounts, err := newStateStore(filepath.Join(dir, "state.json")).load()
+	if assert.NoError(t, err) {
+		assert.Empty(t, mounts)
+	}
+}
+
+func TestStateRoundTrip(t *testing.T) {
+	dir, cleanup := testStateDir(t)
+	defer cleanup()
+
+	now := time.Now().UTC().Truncate(time.Second)
+	store := newStateStore(filepath.Join(dir, "state.json"))
+	err := store.save(map[string]*mountRecord{
+		"foo/vol": {Repository: "foo", Volume: "vol", Activated: now, IDs: map[string]time.Time{"a": now}},
+	})
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	mounts, err := store.load()
+	if assert.NoError(t, err) && assert.Len(t, mounts, 1) {
+		record := mounts["foo/vol"]
+		assert.Equal(t, "foo", record.Repository)
+		assert.Equal(t, "vol", record.Volume)
+		assert.True(t, now.Equal(record.Activated))
+		assert.True(t, now.Equal(record.IDs["a"]))
+	}
+
+	files, _ := ioutil.ReadDir(dir)
+	assert.Len(t, files, 1)
+}
+
+func TestStateBadVersion(t *testing.T) {
+	dir, cleanup := testStateDir(t)
+	defer cleanup()
+
+	path := filepath.Join(dir, "state.json")
+	ioutil.WriteFile(path, []byte("{\"version\":99,\"mounts\":[]}"), 0644)
+	_, err := newStateStore(path).load()
+	assert.Error(t, err)
+}
+
+func TestStateBadFile(t *testing.T) {
+	dir, cleanup := testStateDir(t)
+	defer cleanup()
+
+	path := filepath.Join(dir, "state.json")
+	ioutil.WriteFile(path, []byte("not json"), 0644)
+	config := DefaultConfig()
+	config.StatePath = path
+	_, err := NewWithConfig(config)
+	assert.Error(t, err)
+}
+
+func TestStateSurvivesRestart(t *testing.T) {
+	dir, cleanup := testStateDir(t)
+	defer cleanup()
+
+	deactivations := 0
+	h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		switch r.RequestURI {
+		case "/v1/repositories/foo/volumes/vol":
+			w.Write([]byte("{\"name\":\"vol\",\"config\":{\"mountpoint\":\"/vol\"}}"))
+		case "/v1/repositories/foo/volumes/vol/deactivate":
+			deactivations++
+			w.WriteHeader(http.StatusNoContent)
+		default:
+			w.WriteHeader(http.StatusNoContent)
+		}
+	})
+	config := DefaultConfig()
+	config.StatePath = filepath.Join(dir, "state.json")
+
+	f, teardown := testForwarderWithConfig(h, config)
+	assert.Empty(t, f.MountVolume(context.Background(), MountVolumeRequest{Name: "foo/vol", ID: "a"}).Err)
+	assert.Empty(t, f.MountVolume(context.Background(), MountVolumeRequest{Name: "foo/vol", ID: "b"}).Err)
+	teardown()
+
+	f, teardown = testForwarderWithConfig(h, config)
+	defer teardown()
+	assert.Empty(t, f.UnmountVolume(context.Background(), MountVolumeRequest{Name: "foo/vol", ID: "a"}).Err)
+	assert.Equal(t, 0, deactivations)
+	assert.Empty(t, f.UnmountVolume(context.Background(), MountVolumeRequest{Name: "foo/vol", ID: "b"}).Err)
+	assert.Equal(t, 1, deactivations)
+}
+
+func TestStateFlush(t *testing.T) {
+	dir, cleanup := testStateDir(t)
+	defer cleanup()
+
+	h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		if r.RequestURI == "/v1/repositories/foo/volumes/vol" {
+			w.Write([]byte("{\"name\":\"vol\",\"config\":{\"mountpoint\":\"/vol\"}}"))
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	})
+	config := DefaultConfig()
+	config.StatePath = filepath.Join(dir, "state.json")
+	config.Cache.TTL = Duration(time.Second)
+	f, teardown := testForwarderWithConfig(h, config)
+	defer teardown()
+	assert.Empty(t, f.MountVolume(context.Background(), MountVolumeRequest{Name: "foo/vol", ID: "a"}).Err)
+
+	os.Remove(config.StatePath)
+	assert.NoError(t, f.(Flusher).Flush())
+	mounts, err := newStateStore(config.StatePath).load()
+	if assert.NoError(t, err) {
+		assert.Contains(t, mounts, "foo/vol")
+	}
+}
+
+func TestStateCreatesDirectory(t *testing.T) {
+	dir, cleanup := testStateDir(t)
+	defer cleanup()
+
+	store := newStateStore(filepath.Join(dir, "missing", "state.json"))
+	assert.NoError(t, store.save(map[string]*mountRecord{}))
+	mounts, err := store.load()
+	if assert.NoError(t, err) {
+		assert.Empty(t, mounts)
+	}
+}
@@ -0,0 +1,139 @@
+/*
+ * Copyright The Titan Project Contributors.
+ */
+
+package forwarder
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	titan "github.com/titan-data/titan-client-go"
+	"github.com/titan-data/titan-docker-proxy/internal/logging"
+	"strconv"
+)
+
+/*
+ * Docker shows the Status map of a volume in "docker volume inspect", so we fill it with whatever titan metadata is
+ * useful. Each group of fields can be turned on or off, since some of them (the repository commit fields) cost extra
+ * calls to titan-server. Status values must be strings, so nested properties are flattened into dotted keys (or
+ * whatever separator is configured), and any other non-string values are JSON encoded.
+ */
+const (
+	// Volume properties, as "properties.<key>"
+	StatusProperties = "properties"
+	// Source commit of the repository's current state, as "commit"
+	StatusCommit = "commit"
+	// Whether the volume is mounted through the proxy, as "active", and by how many containers, as "mounts"
+	StatusActive = "active"
+	// Latest commit in the repository and its timestamp, as "lastCommit" and "lastCommitTimestamp"
+	StatusLastCommit = "lastCommit"
+	// Address of the titan-server, as "endpoint", and the state of its circuit breaker, as "circuit"
+	StatusEndpoint = "endpoint"
+)
+
+type StatusConfig struct {
+	Fields    []string `json:"fields"`
+	Separator string   `json:"separator"`
+}
+
+func (c StatusConfig) fieldSet() (map[string]bool, error) {
+	fields := map[string]bool{}
+	for _, field := range c.Fields {
+		switch field {
+		case StatusProperties, StatusCommit, StatusActive, StatusLastCommit, StatusEndpoint:
+			fields[field] = true
+		default:
+			return nil, fmt.Errorf("invalid volume status field '%s'", field)
+		}
+	}
+	if c.Separator == "" && fields[StatusProperties] {
+		return nil, fmt.Errorf("volume status separator cannot be empty")
+	}
+	return fields, nil
+}
+
+func statusValue(value interface{}) string {
+	if s, ok := value.(string); ok {
+		return s
+	}
+	encoded, err := json.Marshal(value)
+	if err != nil {
+		return fmt.Sprintf("%v", value)
+	}
+	return string(encoded)
+}
+
+func (p forwarder) flattenStatus(prefix string, value interface{}, status map[string]string) {
+	if nested, ok := value.(map[string]interface{}); ok && len(nested) != 0 {
+		for k, v := range nested {
+			p.flattenStatus(prefix+p.statusSeparator+k, v, status)
+		}
+		return
+	}
+	status[prefix] = statusValue(value)
+}
+
+/*
+ * Returns the status fields that are common to every volume in a repository, so that they only need to be fetched
+ * once when listing. Failures are logged rather than returned, as missing status shouldn't make a volume disappear.
+ */
+func (p forwarder) repositoryStatus(ctx context.Context, repoName string) map[string]string {
+	status := map[string]string{}
+	if !p.statusFields[StatusCommit] && !p.statusFields[StatusLastCommit] {
+		return status
+	}
+
+	repoStatus, _, err := p.client.GetRepositoryStatus(ctx, repoName)
+	if err != nil {
+		p.log.Warn("unable to get repository status", logging.Repository(repoName), errorField(err))
+		return status
+	}
+
+	if p.statusFields[StatusCommit] && repoStatus.SourceCommit != "" {
+		status["commit"] = repoStatus.SourceCommit
+	}
+
+	if p.statusFields[StatusLastCommit] && repoStatus.LastCommit != "" {
+		status["lastCommit"] = repoStatus.LastCommit
+		var commit titan.Commit
+		commit, _, err = p.client.GetCommit(ctx, repoName, repoStatus.LastCommit)
+		if err != nil {
+			p.log.Warn("unable to get last commit", logging.Repository(repoName),
+				logging.F("commit", repoStatus.LastCommit), errorField(err))
+		} else if timestamp, ok := commit.Properties["timestamp"]; ok {
+			status["lastCommitTimestamp"] = statusValue(timestamp)
+		}
+	}
+
+	return status
+}
+
+/*
+ * Builds the status map for a single volume, starting from the repository status.
+ */
+func (p forwarder) volumeStatus(repoName string, vol titan.Volume, repoStatus map[string]string) map[string]string {
+	status := map[string]string{}
+	for k, v := range repoStatus {
+		status[k] = v
+	}
+
+	if p.statusFields[StatusProperties] {
+		for k, v := range vol.Properties {
+			p.flattenStatus(StatusProperties+p.statusSeparator+k, v, status)
+		}
+	}
+
+	if p.statusFields[StatusActive] {
+		count := p.mounts.count(repoName, vol.Name)
+		status["active"] = strconv.FormatBool(count != 0)
+		status["mounts"] = strconv.Itoa(count)
+	}
+
+	if p.statusFields[StatusEndpoint] {
+		status["endpoint"] = p.endpoint
+		status["circuit"] = p.client.breaker.State()
+	}
+
+	return status
+}
@@ -0,0 +1,93 @@
+/*
+ * Copyright The Titan Project Contributors.
+ */
+
+package forwarder
+
+import (
+	"context"
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"testing"
+)
+
+func statusHandler(t *testing.T) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		switch r.RequestURI {
+		case "/v1/repositories/foo/volumes/vol":
+			w.Write([]byte("{\"name\":\"vol\",\"config\":{\"mountpoint\":\"/vol\"}," +
+				"\"properties\":{\"a\":\"b\",\"n\":1,\"nested\":{\"c\":\"d\",\"list\":[1,2]}}}"))
+		case "/v1/repositories/foo/volumes/vol/activate":
+			w.WriteHeader(http.StatusNoContent)
+		case "/v1/repositories/foo/status":
+			w.Write([]byte("{\"lastCommit\":\"c2\",\"sourceCommit\":\"c1\"}"))
+		case "/v1/repositories/foo/commits/c2":
+			w.Write([]byte("{\"id\":\"c2\",\"properties\":{\"timestamp\":\"2019-09-20T13:45:38Z\"}}"))
+		default:
+			t.Errorf("unexpected request %s", r.RequestURI)
+		}
+	})
+}
+
+func TestVolumeStatusAllFields(t *testing.T) {
+	config := DefaultConfig()
+	config.Status.Fields = []string{StatusProperties, StatusCommit, StatusActive, StatusLastCommit, StatusEndpoint}
+	f, teardown := testForwarderWithConfig(statusHandler(t), config)
+	defer teardown()
+
+	assert.Empty(t, f.MountVolume(context.Background(), MountVolumeRequest{Name: "foo/vol", ID: "a"}).Err)
+
+	resp := f.GetVolume(context.Background(), VolumeRequest{Name: "foo/vol"})
+	if assert.Empty(t, resp.Err) {
+		assert.Equal(t, map[string]string{
+			"properties.a":           "b",
+			"properties.n":           "1",
+			"properties.nested.c":    "d",
+			"properties.nested.list": "[1,2]",
+			"commit":                 "c1",
+			"active":                 "true",
+			"mounts":                 "1",
+			"lastCommit":             "c2",
+			"lastCommitTimestamp":    "2019-09-20T13:45:38Z",
+			"endpoint":               "localhost:5001",
+			"circuit":                "closed",
+		}, resp.Volume.Status)
+	}
+}
+
+func TestVolumeStatusSeparator(t *testing.T) {
+	config := DefaultConfig()
+	config.Status = StatusConfig{Fields: []string{StatusProperties}, Separator: "/"}
+	f, teardown := testForwarderWithConfig(statusHandler(t), config)
+	defer teardown()
+
+	resp := f.GetVolume(context.Background(), VolumeRequest{Name: "foo/vol"})
+	if assert.Empty(t, resp.Err) {
+		assert.Equal(t, map[string]string{
+			"properties/a":           "b",
+			"properties/n":           "1",
+			"properties/nested/c":    "d",
+			"properties/nested/list": "[1,2]",
+		}, resp.Volume.Status)
+	}
+}
+
+func TestVolumeStatusNoFields(t *testing.T) {
+	config := DefaultConfig()
+	config.Status.Fields = []string{}
+	f, teardown := testForwarderWithConfig(statusHandler(t), config)
+	defer teardown()
+
+	resp := f.GetVolume(context.Background(), VolumeRequest{Name: "foo/vol"})
+	if assert.Empty(t, resp.Err) {
+		assert.Empty(t, resp.Volume.Status)
+	}
+}
+
+func TestVolumeStatusBadField(t *testing.T) {
+	config := DefaultConfig()
+	config.Status.Fields = []string{"bogus"}
+	_, err := NewWithConfig(config)
+	assert.Error(t, err)
+}
@@ -0,0 +1,175 @@
+/*
+ * Copyright The Titan Project Contributors.
+ */
+
+package forwarder
+
+import (
+	"context"
+	titan "github.com/titan-data/titan-client-go"
+	"github.com/titan-data/titan-docker-proxy/internal/logging"
+	"net/http"
+)
+
+/*
+ * All calls to titan-server go through this wrapper rather than the generated client, so that policies that apply to
+ * every call (such as retrying transient failures, or failing fast when titan-server is down) live in one place. Each
+ * method mirrors the generated API method of the same name, and records whether the operation is safe to retry. Reads
+ * are always safe, as are activation and deactivation, which titan-server treats idempotently. Anything that creates or
+ * deletes is not, since a request that failed in transit may have been applied anyway.
+ */
+type titanClient struct {
+	api     *titan.APIClient
+	retry   RetryConfig
+	breaker *circuitBreaker
+	limiter *limiter
+	log     *logging.Logger
+}
+
+func newTitanClient(config *titan.Configuration, retry RetryConfig, breaker BreakerConfig, limits LimitsConfig,
+	log *logging.Logger) *titanClient {
+	return &titanClient{
+		api:     titan.NewAPIClient(config),
+		retry:   retry,
+		breaker: newCircuitBreaker(breaker, log),
+		limiter: newLimiter(limits, log),
+		log:     log,
+	}
+}
+
+func (c *titanClient) ListRepositories(ctx context.Context) ([]titan.Repository, *http.Response, error) {
+	var ret []titan.Repository
+	resp, err := c.call(ctx, "ListRepositories", true, func() (*http.Response, error) {
+		var resp *http.Response
+		var err error
+		ret, resp, err = c.api.RepositoriesApi.ListRepositories(ctx)
+		return resp, err
+	})
+	return ret, resp, err
+}
+
+func (c *titanClient) GetRepository(ctx context.Context, repoName string) (titan.Repository, *http.Response, error) {
+	var ret titan.Repository
+	resp, err := c.call(ctx, "GetRepository", true, func() (*http.Response, error) {
+		var resp *http.Response
+		var err error
+		ret, resp, err = c.api.RepositoriesApi.GetRepository(ctx, repoName)
+		return resp, err
+	})
+	return ret, resp, err
+}
+
+func (c *titanClient) GetRepositoryStatus(ctx context.Context, repoName string) (titan.RepositoryStatus,
+	*http.Response, error) {
+	var ret titan.RepositoryStatus
+	resp, err := c.call(ctx, "GetRepositoryStatus", true, func() (*http.Response, error) {
+		var resp *http.Response
+		var err error
+		ret, resp, err = c.api.RepositoriesApi.GetRepositoryStatus(ctx, repoName)
+		return resp, err
+	})
+	return ret, resp, err
+}
+
+func (c *titanClient) CreateRepository(ctx context.Context, repo titan.Repository) (titan.Repository,
+	*http.Response, error) {
+	var ret titan.Repository
+	resp, err := c.call(ctx, "CreateRepository", false, func() (*http.Response, error) {
+		var resp *http.Response
+		var err error
+		ret, resp, err = c.api.RepositoriesApi.CreateRepository(ctx, repo)
+		return resp, err
+	})
+	return ret, resp, err
+}
+
+func (c *titanClient) DeleteRepository(ctx context.Context, repoName string) (*http.Response, error) {
+	return c.call(ctx, "DeleteRepository", false, func() (*http.Response, error) {
+		return c.api.RepositoriesApi.DeleteRepository(ctx, repoName)
+	})
+}
+
+func (c *titanClient) ListVolumes(ctx context.Context, repoName string) ([]titan.Volume, *http.Response, error) {
+	var ret []titan.Volume
+	resp, err := c.call(ctx, "ListVolumes", true, func() (*http.Response, error) {
+		var resp *http.Response
+		var err error
+		ret, resp, err = c.api.VolumesApi.ListVolumes(ctx, repoName)
+		return resp, err
+	})
+	return ret, resp, err
+}
+
+func (c *titanClient) GetVolume(ctx context.Context, repoName string, volumeName string) (titan.Volume,
+	*http.Response, error) {
+	var ret titan.Volume
+	resp, err := c.call(ctx, "GetVolume", true, func() (*http.Response, error) {
+		var resp *http.Response
+		var err error
+		ret, resp, err = c.api.VolumesApi.GetVolume(ctx, repoName, volumeName)
+		return resp, err
+	})
+	return ret, resp, err
+}
+
+func (c *titanClient) GetVolumeStatus(ctx context.Context, repoName string, volumeName string) (titan.VolumeStatus,
+	*http.Response, error) {
+	var ret titan.VolumeStatus
+	resp, err := c.call(ctx, "GetVolumeStatus", true, func() (*http.Response, error) {
+		var resp *http.Response
+		var err error
+		ret, resp, err = c.api.VolumesApi.GetVolumeStatus(ctx, repoName, volumeName)
+		return resp, err
+	})
+	return ret, resp, err
+}
+
+func (c *titanClient) CreateVolume(ctx context.Context, repoName string, vol titan.Volume) (titan.Volume,
+	*http.Response, error) {
+	var ret titan.Volume
+	resp, err := c.call(ctx, "CreateVolume", false, func() (*http.Response, error) {
+		var resp *http.Response
+		var err error
+		ret, resp, err = c.api.VolumesApi.CreateVolume(ctx, repoName, vol)
+		return resp, err
+	})
+	return ret, resp, err
+}
+
+func (c *titanClient) DeleteVolume(ctx context.Context, repoName string, volumeName string) (*http.Response, error) {
+	return c.call(ctx, "DeleteVolume", false, func() (*http.Response, error) {
+		return c.api.VolumesApi.DeleteVolume(ctx, repoName, volumeName)
+	})
+}
+
+func (c *titanClient) ActivateVolume(ctx context.Context, repoName string, volumeName string) (*http.Response,
+	error) {
+	return c.call(ctx, "ActivateVolume", true, func() (*http.Response, error) {
+		return c.api.VolumesApi.ActivateVolume(ctx, repoName, volumeName)
+	})
+}
+
+func (c *titanClient) DeactivateVolume(ctx context.Context, repoName string, volumeName string) (*http.Response,
+	error) {
+	return c.call(ctx, "DeactivateVolume", true, func() (*http.Response, error) {
+		return c.api.VolumesApi.DeactivateVolume(ctx, repoName, volumeName)
+	})
+}
+
+func (c *titanClient) GetCommit(ctx context.Context, repoName string, commitId string) (titan.Commit, *http.Response,
+	error) {
+	var ret titan.Commit
+	resp, err := c.call(ctx, "GetCommit", true, func() (*http.Response, error) {
+		var resp *http.Response
+		var err error
+		ret, resp, err = c.api.CommitsApi.GetCommit(ctx, repoName, commitId)
+		return resp, err
+	})
+	return ret, resp, err
+}
+
+func (c *titanClient) CheckoutCommit(ctx context.Context, repoName string, commitId string) (*http.Response, error) {
+	return c.call(ctx, "CheckoutCommit", false, func() (*http.Response, error) {
+		return c.api.CommitsApi.CheckoutCommit(ctx, repoName, commitId)
+	})
+}
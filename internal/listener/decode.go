@@ -0,0 +1,82 @@
+/*
+ * Copyright The Titan Project Contributors.
+ */
+package listener
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+)
+
+/*
+ * Requests are decoded strictly, so that a malformed request fails outright rather than reaching the forwarder as a
+ * zero-valued request (which could, for example, try to unmount a volume with an empty name). Bodies larger than the
+ * configured limit are rejected without being read in full. Unknown fields are allowed by default, as docker may add
+ * fields in later versions of the plugin protocol, but can be rejected as well.
+ */
+const DefaultMaxBodySize = 1024 * 1024
+
+/*
+ * A request that was rejected before reaching the forwarder, along with the HTTP status to respond with.
+ */
+type requestError struct {
+	status int
+	err    error
+}
+
+func (e *requestError) Error() string {
+	return e.err.Error()
+}
+
+func (e *requestError) Unwrap() error {
+	return e.err
+}
+
+func badRequest(err error) error {
+	return &requestError{status: http.StatusBadRequest, err: err}
+}
+
+/*
+ * Reads and decodes a request body into req, returning the raw body for logging.
+ */
+func (l *listener) decode(body io.Reader, req interface{}) ([]byte, error) {
+	reader := body
+	if l.maxBodySize > 0 {
+		reader = io.LimitReader(body, l.maxBodySize+1)
+	}
+	data, err := ioutil.ReadAll(reader)
+	if err != nil {
+		return data, badRequest(fmt.Errorf("unable to read request body: %w", err))
+	}
+	if l.maxBodySize > 0 && int64(len(data)) > l.maxBodySize {
+		return nil, &requestError{
+			status: http.StatusRequestEntityTooLarge,
+			err:    fmt.Errorf("request body exceeds %d bytes", l.maxBodySize),
+		}
+	}
+
+	trimmed := bytes.TrimSpace(data)
+	if len(trimmed) == 0 {
+		return data, badRequest(errors.New("missing request body"))
+	}
+	if trimmed[0] != '{' {
+		return data, badRequest(errors.New("invalid request body: must be a JSON object"))
+	}
+
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	if l.strict {
+		decoder.DisallowUnknownFields()
+	}
+	if err = decoder.Decode(req); err != nil {
+		return data, badRequest(fmt.Errorf("invalid request body: %w", err))
+	}
+	if _, err = decoder.Token(); err != io.EOF {
+		return data, badRequest(errors.New("invalid request body: unexpected data after JSON object"))
+	}
+	return data, nil
+}
@@ -0,0 +1,94 @@
+/*
+ * Copyright The Titan Project Contributors.
+ */
+
+package listener
+
+import (
+	"github.com/stretchr/testify/assert"
+	"github.com/titan-data/titan-docker-proxy/internal/forwarder"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func serve(l *listener, method string, path string, body string) *httptest.ResponseRecorder {
+	req, _ := http.NewRequest(method, path, strings.NewReader(body))
+	rr := httptest.NewRecorder()
+	handler, _ := l.mux.Handler(req)
+	handler.ServeHTTP(rr, req)
+	return rr
+}
+
+func TestDecodeMalformed(t *testing.T) {
+	f := new(MockForwarder)
+	l := create(f, "/socket")
+	rr := serve(l, "POST", "/VolumeDriver.Unmount", "{\"Name\":\"foo/vol\",")
+	assert.Equal(t, http.StatusBadRequest, rr.Code)
+	assert.Equal(t, "{\"Err\":\"invalid request body: unexpected EOF\"}", rr.Body.String())
+	f.AssertExpectations(t)
+}
+
+func TestDecodeWrongType(t *testing.T) {
+	f := new(MockForwarder)
+	l := create(f, "/socket")
+	rr := serve(l, "POST", "/VolumeDriver.Remove", "{\"Name\":5}")
+	assert.Equal(t, http.StatusBadRequest, rr.Code)
+	assert.Contains(t, rr.Body.String(), "invalid request body: json: cannot unmarshal number")
+}
+
+func TestDecodeNotObject(t *testing.T) {
+	f := new(MockForwarder)
+	l := create(f, "/socket")
+	for _, body := range []string{"", "  ", "null", "[]", "\"foo\""} {
+		rr := serve(l, "POST", "/VolumeDriver.Get", body)
+		assert.Equal(t, http.StatusBadRequest, rr.Code, body)
+	}
+	f.AssertExpectations(t)
+}
+
+func TestDecodeTrailingData(t *testing.T) {
+	f := new(MockForwarder)
+	l := create(f, "/socket")
+	rr := serve(l, "POST", "/VolumeDriver.Get", "{\"Name\":\"foo/vol\"} {}")
+	assert.Equal(t, http.StatusBadRequest, rr.Code)
+	assert.Equal(t, "{\"Err\":\"invalid request body: unexpected data after JSON object\"}", rr.Body.String())
+}
+
+func TestDecodeUnknownFields(t *testing.T) {
+	f := new(MockForwarder)
+	f.On("GetPath", forwarder.VolumeRequest{Name: "foo/vol"}).
+		Return(forwarder.GetPathResponse{Mountpoint: "/vol"}).Once()
+	l := create(f, "/socket")
+	body := "{\"Name\":\"foo/vol\",\"Extra\":true}"
+
+	rr := serve(l, "POST", "/VolumeDriver.Path", body)
+	assert.Equal(t, http.StatusOK, rr.Code)
+
+	l.SetStrictDecoding(true)
+	rr = serve(l, "POST", "/VolumeDriver.Path", body)
+	assert.Equal(t, http.StatusBadRequest, rr.Code)
+	assert.Equal(t, "{\"Err\":\"invalid request body: json: unknown field \\\"Extra\\\"\"}", rr.Body.String())
+	f.AssertExpectations(t)
+}
+
+func TestDecodeTooLarge(t *testing.T) {
+	f := new(MockForwarder)
+	l := create(f, "/socket")
+	l.SetMaxBodySize(16)
+	rr := serve(l, "POST", "/VolumeDriver.Get", "{\"Name\":\"a-rather-long-volume-name\"}")
+	assert.Equal(t, http.StatusRequestEntityTooLarge, rr.Code)
+	assert.Equal(t, "{\"Err\":\"request body exceeds 16 bytes\"}", rr.Body.String())
+	f.AssertExpectations(t)
+}
+
+func TestWrongMethod(t *testing.T) {
+	f := new(MockForwarder)
+	l := create(f, "/socket")
+	rr := serve(l, "GET", "/VolumeDriver.List", "")
+	assert.Equal(t, http.StatusMethodNotAllowed, rr.Code)
+	assert.Equal(t, "POST", rr.Header().Get("Allow"))
+	assert.Equal(t, "{\"Err\":\"method GET not allowed\"}", rr.Body.String())
+	f.AssertExpectations(t)
+}
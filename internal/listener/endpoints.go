@@ -0,0 +1,162 @@
+/*
+ * Copyright The Titan Project Contributors.
+ */
+package listener
+
+import (
+	"context"
+	"fmt"
+	"github.com/titan-data/titan-docker-proxy/internal/forwarder"
+)
+
+/*
+ * Every endpoint has a hand-written adapter that decodes its request (if it has one) and invokes the matching
+ * forwarder method, so dispatch needs no reflection. The two halves are separate so that middleware can run in
+ * between, seeing the decoded request. As middleware can also replace the request, invoking checks that it's still of
+ * the type the endpoint expects, and fails the request with an error if not.
+ */
+type endpoint struct {
+	// Decodes the endpoint's request, or nil if it takes none
+	decode func(decode decodeFunc) (interface{}, error)
+	invoke func(ctx context.Context, request interface{}) interface{}
+}
+
+/*
+ * Decodes the request body into the given request, returning a *requestError if it can't.
+ */
+type decodeFunc func(req interface{}) error
+
+func decodeVolumeRequest(decode decodeFunc) (interface{}, error) {
+	var request forwarder.VolumeRequest
+	err := decode(&request)
+	return request, err
+}
+
+func decodeMountVolumeRequest(decode decodeFunc) (interface{}, error) {
+	var request forwarder.MountVolumeRequest
+	err := decode(&request)
+	return request, err
+}
+
+func endpoints(f forwarder.Forwarder) map[string]endpoint {
+	return map[string]endpoint{
+		forwarder.EndpointPluginActivate: {
+			invoke: func(ctx context.Context, request interface{}) interface{} {
+				return f.PluginActivate(ctx)
+			},
+		},
+		forwarder.EndpointCapabilities: {
+			invoke: func(ctx context.Context, request interface{}) interface{} {
+				return f.VolumeCapabilities(ctx)
+			},
+		},
+		forwarder.EndpointCreate: {
+			decode: func(decode decodeFunc) (interface{}, error) {
+				var request forwarder.CreateVolumeRequest
+				err := decode(&request)
+				return request, err
+			},
+			invoke: func(ctx context.Context, request interface{}) interface{} {
+				req, ok := request.(forwarder.CreateVolumeRequest)
+				if !ok {
+					return wrongRequest(request)
+				}
+				return f.CreateVolume(ctx, req)
+			},
+		},
+		forwarder.EndpointGet: {
+			decode: decodeVolumeRequest,
+			invoke: func(ctx context.Context, request interface{}) interface{} {
+				req, ok := request.(forwarder.VolumeRequest)
+				if !ok {
+					return wrongRequest(request)
+				}
+				return f.GetVolume(ctx, req)
+			},
+		},
+		forwarder.EndpointPath: {
+			decode: decodeVolumeRequest,
+			invoke: func(ctx context.Context, request interface{}) interface{} {
+				req, ok := request.(forwarder.VolumeRequest)
+				if !ok {
+					return wrongRequest(request)
+				}
+				return f.GetPath(ctx, req)
+			},
+		},
+		forwarder.EndpointList: {
+			invoke: func(ctx context.Context, request interface{}) interface{} {
+				return f.ListVolumes(ctx)
+			},
+		},
+		forwarder.EndpointMount: {
+			decode: decodeMountVolumeRequest,
+			invoke: func(ctx context.Context, request interface{}) interface{} {
+				req, ok := request.(forwarder.MountVolumeRequest)
+				if !ok {
+					return wrongRequest(request)
+				}
+				return f.MountVolume(ctx, req)
+			},
+		},
+		forwarder.EndpointRemove: {
+			decode: decodeVolumeRequest,
+			invoke: func(ctx context.Context, request interface{}) interface{} {
+				req, ok := request.(forwarder.VolumeRequest)
+				if !ok {
+					return wrongRequest(request)
+				}
+				return f.RemoveVolume(ctx, req)
+			},
+		},
+		forwarder.EndpointUnmount: {
+			decode: decodeMountVolumeRequest,
+			invoke: func(ctx context.Context, request interface{}) interface{} {
+				req, ok := request.(forwarder.MountVolumeRequest)
+				if !ok {
+					return wrongRequest(request)
+				}
+				return f.UnmountVolume(ctx, req)
+			},
+		},
+	}
+}
+
+/*
+ * The response to a request that isn't of the type its endpoint expects.
+ */
+func wrongRequest(request interface{}) interface{} {
+	return forwarder.VolumeResponse{Err: fmt.Sprintf("invalid request of type %T", request)}
+}
+
+/*
+ * Returns the volume and mount ID a request is about, if any, for logging.
+ */
+func describeRequest(request interface{}) (string, string) {
+	switch req := request.(type) {
+	case forwarder.CreateVolumeRequest:
+		return req.Name, ""
+	case forwarder.VolumeRequest:
+		return req.Name, ""
+	case forwarder.MountVolumeRequest:
+		return req.Name, req.ID
+	}
+	return "", ""
+}
+
+/*
+ * Returns the error reported by a response, if any.
+ */
+func responseErr(response interface{}) string {
+	switch resp := response.(type) {
+	case forwarder.VolumeResponse:
+		return resp.Err
+	case forwarder.GetVolumeResponse:
+		return resp.Err
+	case forwarder.GetPathResponse:
+		return resp.Err
+	case forwarder.ListVolumeResponse:
+		return resp.Err
+	}
+	return ""
+}
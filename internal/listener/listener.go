@@ -4,123 +4,289 @@
 package listener
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"github.com/titan-data/titan-docker-proxy/internal/forwarder"
-	"io/ioutil"
+	"github.com/titan-data/titan-docker-proxy/internal/logging"
 	"net"
 	"net/http"
-	"reflect"
+	"os"
+	"sync"
+	"syscall"
+	"time"
 )
 
 /*
  * The listener is responsible for listening on a Unix Domain Socket for docker requests, marshaling data to and from
- * JSON, and invoking the appropriate methods of the forwarder to then make calls to titan-server. Because this is so
- * generic, we are able to implement a generic interposition layer and use reflection to do all the work.
+ * JSON, and invoking the appropriate methods of the forwarder to then make calls to titan-server. The handling common
+ * to every endpoint lives in the handler, while the endpoint table (see endpoints.go) adapts each endpoint to its
+ * forwarder method. Middleware (see middleware.go) runs in between the two.
  */
 
 type Listener interface {
 	Listen() error
+	Shutdown(ctx context.Context) error
 	SetLogging(enabled bool)
+	SetLogger(logger *logging.Logger)
+	SetMaxBodySize(size int64)
+	SetStrictDecoding(enabled bool)
+	Use(middleware ...Middleware)
 }
 
 type listener struct {
-	forw forwarder.Forwarder
-	path string
-	mux  *http.ServeMux
-	log  bool
+	forw        forwarder.Forwarder
+	path        string
+	mux         *http.ServeMux
+	server      *http.Server
+	log         bool
+	logger      *logging.Logger
+	maxBodySize int64
+	strict      bool
+	endpoints   map[string]endpoint
+	middleware  []Middleware
+	chain       Handler
+
+	lock      sync.Mutex
+	listening bool
 }
 
-type handler struct {
-	listen *listener
-	req    interface{}
-	fun    interface{}
+type httpHandler struct {
+	listen   *listener
+	endpoint string
+	ep       endpoint
 }
 
 /*
- * The main handler method. This will detect whether the method expects zero arguments or one, handles marshaling,
- * and errors while invoking the given method on the forwarder.
+ * The main handler method. This decodes the request, runs it through the middleware chain to the forwarder, and
+ * encodes its response, handling errors along the way. The context of the HTTP request is passed through, so that
+ * the forwarder stops work if docker goes away. Requests that can't be decoded are rejected without calling the
+ * forwarder at all. Every request is logged once it completes, along with the request and response bodies if enabled.
  */
-func (h handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	var response []reflect.Value
-	var err error
-
-	funcValue := reflect.ValueOf(h.fun)
-	if h.req != nil {
-		body, err := ioutil.ReadAll(r.Body)
-		if h.listen.log {
-			fmt.Printf("%s %-24s -> %s", r.Method, r.RequestURI, string(body))
-		}
-		if err == nil {
-			err = json.Unmarshal(body, h.req)
-		}
+func (h httpHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	start := time.Now()
+	request := Request{Endpoint: h.endpoint}
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		h.fail(w, start, request, nil, fmt.Errorf("method %s not allowed", r.Method), http.StatusMethodNotAllowed)
+		return
+	}
 
-		response = funcValue.Call([]reflect.Value{reflect.ValueOf(h.req).Elem()})
-	} else {
-		if h.listen.log {
-			fmt.Printf("%s %-24s ->\n", r.Method, r.RequestURI)
+	var requestBody []byte
+	if h.ep.decode != nil {
+		var err error
+		request.Body, err = h.ep.decode(func(req interface{}) error {
+			var err error
+			requestBody, err = h.listen.decode(r.Body, req)
+			return err
+		})
+		if err != nil {
+			h.fail(w, start, Request{Endpoint: h.endpoint}, requestBody, err, http.StatusInternalServerError)
+			return
 		}
-		response = funcValue.Call([]reflect.Value{})
 	}
 
-	var body []byte
-	if err == nil {
-		response = reflect.ValueOf(json.Marshal).Call(response)
-		body = response[0].Bytes()
-		if !response[1].IsNil() {
-			err = response[1].Interface().(error)
-		}
+	response, err := h.listen.serve(r.Context(), request)
+	if err != nil {
+		h.fail(w, start, request, requestBody, err, http.StatusInternalServerError)
+		return
+	}
+	if response.Body == nil {
+		response.Body = forwarder.VolumeResponse{}
 	}
 
+	body, err := json.Marshal(response.Body)
 	if err != nil {
-		body, err = json.Marshal(forwarder.VolumeResponse{Err: err.Error()})
+		h.fail(w, start, request, requestBody, err, http.StatusInternalServerError)
+		return
 	}
 
-	if body == nil {
+	w.WriteHeader(http.StatusOK)
+	w.Write(body)
+	h.logRequest(request, time.Since(start), response.Err(), requestBody, body)
+}
+
+/*
+ * Responds with an error in the form docker expects. Request errors carry their own status, and anything else is
+ * reported with the given one.
+ */
+func (h httpHandler) fail(w http.ResponseWriter, start time.Time, request Request, requestBody []byte, err error,
+	status int) {
+	if reqErr, ok := err.(*requestError); ok {
+		status = reqErr.status
+	}
+	body, marshalErr := json.Marshal(forwarder.VolumeResponse{Err: err.Error()})
+	if marshalErr != nil {
 		body = []byte("{\"Err\":\"Unable to serialize error response\"}")
 	}
 
-	w.WriteHeader(http.StatusOK)
+	w.WriteHeader(status)
+	w.Write(body)
+	h.logRequest(request, time.Since(start), err.Error(), requestBody, body)
+}
+
+/*
+ * Successful requests are only of interest when debugging, as docker makes so many of them. Failed requests are
+ * logged as informational, since many failures (such as looking up a volume that doesn't exist) are routine.
+ */
+func (h httpHandler) logRequest(request Request, duration time.Duration, responseErr string, requestBody []byte,
+	responseBody []byte) {
+	level := logging.LevelDebug
+	if responseErr != "" {
+		level = logging.LevelInfo
+	}
+	logger := h.listen.logger
+	if !logger.Enabled(level) {
+		return
+	}
+
+	fields := []logging.Field{logging.Endpoint(h.endpoint), logging.Duration(duration)}
+	volume, mountID := describeRequest(request.Body)
+	if volume != "" {
+		fields = append(fields, logging.Volume(volume))
+	}
+	if mountID != "" {
+		fields = append(fields, logging.MountID(mountID))
+	}
+	if responseErr != "" {
+		fields = append(fields, logging.F("error", responseErr))
+	}
 	if h.listen.log {
-		fmt.Printf("%s %-24s <- %s\n", r.Method, r.RequestURI, string(body))
+		fields = append(fields, logging.F("request", string(requestBody)), logging.F("response", string(responseBody)))
+	}
+
+	if level == logging.LevelDebug {
+		logger.Debug("request completed", fields...)
+	} else {
+		logger.Info("request failed", fields...)
 	}
-	w.Write(body)
 }
 
-func create(forward forwarder.Forwarder, path string) listener {
+func create(forward forwarder.Forwarder, path string) *listener {
 	l := &listener{
-		forw: forward,
-		path: path,
-		mux:  http.NewServeMux(),
-		log: false,
-	}
-
-	l.mux.Handle("/Plugin.Activate", handler{l, nil, forward.PluginActivate})
-	l.mux.Handle("/VolumeDriver.Capabilities", handler{l, nil, forward.VolumeCapabilities})
-	l.mux.Handle("/VolumeDriver.Create", handler{l, &forwarder.CreateVolumeRequest{}, forward.CreateVolume})
-	l.mux.Handle("/VolumeDriver.Get", handler{l, &forwarder.VolumeRequest{}, forward.GetVolume})
-	l.mux.Handle("/VolumeDriver.Path", handler{l, &forwarder.VolumeRequest{}, forward.GetPath})
-	l.mux.Handle("/VolumeDriver.List", handler{l, nil, forward.ListVolumes})
-	l.mux.Handle("/VolumeDriver.Mount", handler{l, &forwarder.MountVolumeRequest{}, forward.MountVolume})
-	l.mux.Handle("/VolumeDriver.Remove", handler{l, &forwarder.VolumeRequest{}, forward.RemoveVolume})
-	l.mux.Handle("/VolumeDriver.Unmount", handler{l, &forwarder.MountVolumeRequest{}, forward.UnmountVolume})
-
-	return *l
+		forw:      forward,
+		path:      path,
+		mux:       http.NewServeMux(),
+		log:       false,
+		logger:    logging.Default(),
+		endpoints: endpoints(forward),
+
+		maxBodySize: DefaultMaxBodySize,
+	}
+	l.chain = l.invoke
+	l.server = &http.Server{Handler: l.mux}
+
+	for name, ep := range l.endpoints {
+		l.mux.Handle("/"+name, httpHandler{l, name, ep})
+	}
+
+	return l
 }
 
-func (l listener) Listen() error {
+/*
+ * Serves requests on the socket until Shutdown() is called, at which point this returns nil without waiting for the
+ * shutdown to complete.
+ */
+func (l *listener) Listen() error {
+	if err := l.removeStaleSocket(); err != nil {
+		return err
+	}
 	listen, err := net.Listen("unix", l.path)
 	if err != nil {
 		return fmt.Errorf("listen failed on %s: %w", l.path, err)
 	}
+	l.lock.Lock()
+	l.listening = true
+	l.lock.Unlock()
 
-	return http.Serve(listen, l.mux)
+	err = l.server.Serve(listen)
+	if err == http.ErrServerClosed {
+		return nil
+	}
+	return err
 }
 
-func (l listener) SetLogging(enabled bool) {
+/*
+ * A proxy that was killed leaves its socket behind, and listening on it again fails with "address already in use".
+ * The socket is only removed if nothing is listening on it, so that we never take over from another running proxy.
+ */
+func (l *listener) removeStaleSocket() error {
+	info, err := os.Lstat(l.path)
+	if err != nil || info.Mode()&os.ModeSocket == 0 {
+		// Either there's nothing to remove, or it isn't ours to remove, and listening will report why
+		return nil
+	}
+
+	conn, err := net.DialTimeout("unix", l.path, time.Second)
+	if err == nil {
+		conn.Close()
+		return fmt.Errorf("another process is already listening on %s", l.path)
+	}
+	if !errors.Is(err, syscall.ECONNREFUSED) {
+		return nil
+	}
+	if err = os.Remove(l.path); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("unable to remove stale socket %s: %w", l.path, err)
+	}
+	l.logger.Info("removed stale socket", logging.F("socket", l.path))
+	return nil
+}
+
+/*
+ * Stops accepting requests and waits for those in flight to finish. If the context is done first, the remaining
+ * requests are abandoned, which cancels their calls to titan-server. Either way, the forwarder's state is then
+ * flushed and the socket removed, so that the proxy can be started again cleanly.
+ */
+func (l *listener) Shutdown(ctx context.Context) error {
+	err := l.server.Shutdown(ctx)
+	if err != nil {
+		l.logger.Warn("abandoning requests still in flight", logging.Error(err))
+		l.server.Close()
+	}
+
+	if flusher, ok := l.forw.(forwarder.Flusher); ok {
+		if flushErr := flusher.Flush(); flushErr != nil && err == nil {
+			err = fmt.Errorf("unable to flush state: %w", flushErr)
+		}
+	}
+
+	l.lock.Lock()
+	listening := l.listening
+	l.lock.Unlock()
+	if listening {
+		if removeErr := os.Remove(l.path); removeErr != nil && !os.IsNotExist(removeErr) && err == nil {
+			err = fmt.Errorf("unable to remove socket %s: %w", l.path, removeErr)
+		}
+	}
+	return err
+}
+
+/*
+ * Enables logging of request and response bodies.
+ */
+func (l *listener) SetLogging(enabled bool) {
 	l.log = enabled
 }
 
+func (l *listener) SetLogger(logger *logging.Logger) {
+	l.logger = logger
+}
+
+/*
+ * Sets the largest request body that will be accepted. 0 or less means no limit.
+ */
+func (l *listener) SetMaxBodySize(size int64) {
+	l.maxBodySize = size
+}
+
+/*
+ * Enables rejecting requests with fields that aren't part of the plugin protocol.
+ */
+func (l *listener) SetStrictDecoding(enabled bool) {
+	l.strict = enabled
+}
+
 func New(forwarder forwarder.Forwarder, path string) Listener {
 	return create(forwarder, path)
 }
@@ -5,60 +5,73 @@
 package listener
 
 import (
+	"bytes"
+	"context"
+	"encoding/json"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/mock"
 	"github.com/titan-data/titan-docker-proxy/internal/forwarder"
+	"github.com/titan-data/titan-docker-proxy/internal/logging"
+	"io/ioutil"
+	"net"
 	"net/http"
 	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
 	"strings"
 	"testing"
+	"time"
 )
 
 type MockForwarder struct {
 	mock.Mock
 }
 
-func (f *MockForwarder) CreateVolume(request forwarder.CreateVolumeRequest) forwarder.VolumeResponse {
+func (f *MockForwarder) CreateVolume(ctx context.Context,
+	request forwarder.CreateVolumeRequest) forwarder.VolumeResponse {
 	args := f.Called(request)
 	return args.Get(0).(forwarder.VolumeResponse)
 }
 
-func (f *MockForwarder) GetPath(request forwarder.VolumeRequest) forwarder.GetPathResponse {
+func (f *MockForwarder) GetPath(ctx context.Context, request forwarder.VolumeRequest) forwarder.GetPathResponse {
 	args := f.Called(request)
 	return args.Get(0).(forwarder.GetPathResponse)
 }
 
-func (f *MockForwarder) GetVolume(request forwarder.VolumeRequest) forwarder.GetVolumeResponse {
+func (f *MockForwarder) GetVolume(ctx context.Context, request forwarder.VolumeRequest) forwarder.GetVolumeResponse {
 	args := f.Called(request)
 	return args.Get(0).(forwarder.GetVolumeResponse)
 }
 
-func (f *MockForwarder) ListVolumes() forwarder.ListVolumeResponse {
+func (f *MockForwarder) ListVolumes(ctx context.Context) forwarder.ListVolumeResponse {
 	args := f.Called()
 	return args.Get(0).(forwarder.ListVolumeResponse)
 }
 
-func (f *MockForwarder) MountVolume(request forwarder.MountVolumeRequest) forwarder.GetPathResponse {
+func (f *MockForwarder) MountVolume(ctx context.Context,
+	request forwarder.MountVolumeRequest) forwarder.GetPathResponse {
 	args := f.Called(request)
 	return args.Get(0).(forwarder.GetPathResponse)
 }
 
-func (f *MockForwarder) PluginActivate() forwarder.PluginDescription {
+func (f *MockForwarder) PluginActivate(ctx context.Context) forwarder.PluginDescription {
 	args := f.Called()
 	return args.Get(0).(forwarder.PluginDescription)
 }
 
-func (f *MockForwarder) RemoveVolume(request forwarder.VolumeRequest) forwarder.VolumeResponse {
+func (f *MockForwarder) RemoveVolume(ctx context.Context, request forwarder.VolumeRequest) forwarder.VolumeResponse {
 	args := f.Called(request)
 	return args.Get(0).(forwarder.VolumeResponse)
 }
 
-func (f *MockForwarder) VolumeCapabilities() forwarder.VolumeCapabilities {
+func (f *MockForwarder) VolumeCapabilities(ctx context.Context) forwarder.VolumeCapabilities {
 	args := f.Called()
 	return args.Get(0).(forwarder.VolumeCapabilities)
 }
 
-func (f *MockForwarder) UnmountVolume(request forwarder.MountVolumeRequest) forwarder.VolumeResponse {
+func (f *MockForwarder) UnmountVolume(ctx context.Context,
+	request forwarder.MountVolumeRequest) forwarder.VolumeResponse {
 	args := f.Called(request)
 	return args.Get(0).(forwarder.VolumeResponse)
 }
@@ -192,3 +205,279 @@ func TestUnmountVolume(t *testing.T) {
 	assert.Equal(t, "{\"Err\":\"\"}", rr.Body.String())
 	f.AssertExpectations(t)
 }
+
+func TestLogging(t *testing.T) {
+	f := new(MockForwarder)
+	f.On("MountVolume", mock.Anything).Return(forwarder.GetPathResponse{Err: "no such volume"})
+	var buf bytes.Buffer
+	var l Listener = create(f, "/socket")
+	l.SetLogger(logging.New(&buf, logging.LevelDebug, logging.FormatText))
+	l.SetLogging(true)
+
+	body := "{\"Name\":\"foo/vol\",\"ID\":\"0\"}"
+	req, _ := http.NewRequest("POST", "/VolumeDriver.Mount", strings.NewReader(body))
+	rr := httptest.NewRecorder()
+	handler, _ := l.(*listener).mux.Handler(req)
+	handler.ServeHTTP(rr, req)
+
+	logged := buf.String()
+	assert.Contains(t, logged, "level=info msg=\"request failed\" endpoint=VolumeDriver.Mount ")
+	assert.Contains(t, logged, " volume=foo/vol mountId=0 error=\"no such volume\" ")
+	assert.Contains(t, logged, " request=\"{\\\"Name\\\":\\\"foo/vol\\\",\\\"ID\\\":\\\"0\\\"}\"")
+	assert.Regexp(t, " duration=[0-9.]+[µnm]?s ", logged)
+}
+
+func TestLoggingLevel(t *testing.T) {
+	f := new(MockForwarder)
+	f.On("ListVolumes").Return(forwarder.ListVolumeResponse{})
+	var buf bytes.Buffer
+	l := create(f, "/socket")
+	l.SetLogger(logging.New(&buf, logging.LevelInfo, logging.FormatText))
+
+	req, _ := http.NewRequest("POST", "/VolumeDriver.List", nil)
+	handler, _ := l.mux.Handler(req)
+	handler.ServeHTTP(httptest.NewRecorder(), req)
+	assert.Empty(t, buf.String())
+}
+
+func TestEveryEndpointHandled(t *testing.T) {
+	table := endpoints(new(MockForwarder))
+	assert.Len(t, table, len(forwarder.Endpoints))
+	for _, endpoint := range forwarder.Endpoints {
+		assert.Contains(t, table, endpoint)
+	}
+}
+
+/*
+ * Returns canned responses, so that benchmarks measure only the listener.
+ */
+type stubForwarder struct {
+	forwarder.Forwarder
+}
+
+func (f stubForwarder) GetVolume(ctx context.Context, request forwarder.VolumeRequest) forwarder.GetVolumeResponse {
+	return forwarder.GetVolumeResponse{
+		Volume: forwarder.Volume{Name: request.Name, Mountpoint: "/vol", Status: map[string]string{"active": "true"}},
+	}
+}
+
+/*
+ * The reflection-based dispatch the endpoint table replaced, kept as a baseline for the benchmarks. Requests are
+ * decoded the same way, so that only dispatch differs.
+ */
+type reflectHandler struct {
+	listen *listener
+	req    interface{}
+	fun    interface{}
+}
+
+func (h reflectHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	reqValue := reflect.New(reflect.TypeOf(h.req).Elem())
+	h.listen.decode(r.Body, reqValue.Interface())
+	response := reflect.ValueOf(h.fun).Call([]reflect.Value{reflect.ValueOf(r.Context()), reqValue.Elem()})
+	response = reflect.ValueOf(json.Marshal).Call(response)
+	w.WriteHeader(http.StatusOK)
+	w.Write(response[0].Bytes())
+}
+
+func benchmarkHandler(b *testing.B, handler http.Handler) {
+	body := []byte("{\"Name\":\"foo/vol\"}")
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		req, _ := http.NewRequest("POST", "/VolumeDriver.Get", bytes.NewReader(body))
+		handler.ServeHTTP(httptest.NewRecorder(), req)
+	}
+}
+
+func BenchmarkTypedDispatch(b *testing.B) {
+	l := create(stubForwarder{}, "/socket")
+	l.SetLogger(logging.Discard())
+	req, _ := http.NewRequest("POST", "/VolumeDriver.Get", nil)
+	handler, _ := l.mux.Handler(req)
+	benchmarkHandler(b, handler)
+}
+
+func BenchmarkReflectDispatch(b *testing.B) {
+	f := stubForwarder{}
+	l := create(f, "/socket")
+	benchmarkHandler(b, reflectHandler{l, &forwarder.VolumeRequest{}, f.GetVolume})
+}
+
+/*
+ * Blocks GetVolume until released or the request is abandoned, recording whether its state was flushed.
+ */
+type blockingForwarder struct {
+	forwarder.Forwarder
+	started  chan struct{}
+	release  chan struct{}
+	canceled chan error
+	flushed  chan struct{}
+}
+
+func newBlockingForwarder() blockingForwarder {
+	return blockingForwarder{
+		started:  make(chan struct{}),
+		release:  make(chan struct{}),
+		canceled: make(chan error, 1),
+		flushed:  make(chan struct{}, 1),
+	}
+}
+
+func (f blockingForwarder) GetVolume(ctx context.Context, request forwarder.VolumeRequest) forwarder.GetVolumeResponse {
+	close(f.started)
+	select {
+	case <-f.release:
+		return forwarder.GetVolumeResponse{Volume: forwarder.Volume{Name: request.Name, Mountpoint: "/vol"}}
+	case <-ctx.Done():
+		f.canceled <- ctx.Err()
+		return forwarder.GetVolumeResponse{Err: ctx.Err().Error()}
+	}
+}
+
+func (f blockingForwarder) Flush() error {
+	f.flushed <- struct{}{}
+	return nil
+}
+
+func testSocket(t *testing.T) (string, func()) {
+	dir, err := ioutil.TempDir("", "titan-docker-proxy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return filepath.Join(dir, "titan.sock"), func() { os.RemoveAll(dir) }
+}
+
+/*
+ * Starts listening in the background, returning once the socket accepts connections.
+ */
+func startListener(t *testing.T, l *listener) chan error {
+	done := make(chan error, 1)
+	go func() {
+		done <- l.Listen()
+	}()
+	for i := 0; i < 200; i++ {
+		if conn, err := net.Dial("unix", l.path); err == nil {
+			conn.Close()
+			return done
+		}
+		select {
+		case err := <-done:
+			t.Fatalf("listen failed: %v", err)
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+	t.Fatal("timed out waiting for listener")
+	return nil
+}
+
+func socketClient(path string) *http.Client {
+	return &http.Client{
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				return (&net.Dialer{}).DialContext(ctx, "unix", path)
+			},
+		},
+	}
+}
+
+func TestShutdownDrainsRequests(t *testing.T) {
+	path, cleanup := testSocket(t)
+	defer cleanup()
+	f := newBlockingForwarder()
+	l := create(f, path)
+	l.SetLogger(logging.Discard())
+	listening := startListener(t, l)
+
+	responses := make(chan string, 1)
+	go func() {
+		resp, err := socketClient(path).Post("http://docker/VolumeDriver.Get", "application/json",
+			strings.NewReader("{\"Name\":\"foo/vol\"}"))
+		if err != nil {
+			responses <- err.Error()
+			return
+		}
+		defer resp.Body.Close()
+		body, _ := ioutil.ReadAll(resp.Body)
+		responses <- string(body)
+	}()
+	<-f.started
+
+	shutdown := make(chan error, 1)
+	go func() {
+		shutdown <- l.Shutdown(context.Background())
+	}()
+	assert.NoError(t, <-listening)
+	close(f.release)
+
+	assert.Equal(t, "{\"Err\":\"\",\"Volume\":{\"Name\":\"foo/vol\",\"Mountpoint\":\"/vol\",\"Status\":null}}",
+		<-responses)
+	assert.NoError(t, <-shutdown)
+	assert.Len(t, f.flushed, 1)
+	_, err := os.Stat(path)
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestShutdownDeadline(t *testing.T) {
+	path, cleanup := testSocket(t)
+	defer cleanup()
+	f := newBlockingForwarder()
+	l := create(f, path)
+	l.SetLogger(logging.Discard())
+	startListener(t, l)
+
+	go socketClient(path).Post("http://docker/VolumeDriver.Get", "application/json",
+		strings.NewReader("{\"Name\":\"foo/vol\"}"))
+	<-f.started
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	assert.Equal(t, context.DeadlineExceeded, l.Shutdown(ctx))
+	select {
+	case err := <-f.canceled:
+		assert.Equal(t, context.Canceled, err)
+	case <-time.After(5 * time.Second):
+		t.Error("request was not abandoned")
+	}
+	assert.Len(t, f.flushed, 1)
+	_, err := os.Stat(path)
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestStaleSocketRemoved(t *testing.T) {
+	path, cleanup := testSocket(t)
+	defer cleanup()
+	stale, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stale.(*net.UnixListener).SetUnlinkOnClose(false)
+	stale.Close()
+
+	f := new(MockForwarder)
+	f.On("PluginActivate").Return(forwarder.PluginDescription{Implements: []string{"VolumeDriver"}})
+	l := create(f, path)
+	l.SetLogger(logging.Discard())
+	startListener(t, l)
+	defer l.Shutdown(context.Background())
+
+	resp, err := socketClient(path).Post("http://docker/Plugin.Activate", "application/json", nil)
+	if assert.NoError(t, err) {
+		resp.Body.Close()
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+	}
+}
+
+func TestSocketInUse(t *testing.T) {
+	path, cleanup := testSocket(t)
+	defer cleanup()
+	other, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer other.Close()
+
+	l := create(new(MockForwarder), path)
+	l.SetLogger(logging.Discard())
+	assert.EqualError(t, l.Listen(), "another process is already listening on "+path)
+}
@@ -0,0 +1,96 @@
+/*
+ * Copyright The Titan Project Contributors.
+ */
+package listener
+
+import (
+	"context"
+	"fmt"
+	"github.com/titan-data/titan-docker-proxy/internal/forwarder"
+	"github.com/titan-data/titan-docker-proxy/internal/logging"
+	"runtime/debug"
+)
+
+/*
+ * Middleware wraps the handling of every endpoint, so that concerns like auth or metrics can be added without
+ * touching the listener itself. Each middleware sees the decoded request on its way in and the response on its way
+ * out, and can short-circuit the request by returning a response without calling the next handler (typically an
+ * ErrorResponse).
+ *
+ * Middleware runs in the order it was added, the first being outermost. Whatever the middleware, a panic anywhere in
+ * the chain (including the forwarder) is recovered and reported to docker as an error, rather than dropping the
+ * connection.
+ */
+type Middleware interface {
+	Handle(ctx context.Context, request Request, next Handler) Response
+}
+
+type MiddlewareFunc func(ctx context.Context, request Request, next Handler) Response
+
+func (f MiddlewareFunc) Handle(ctx context.Context, request Request, next Handler) Response {
+	return f(ctx, request, next)
+}
+
+type Handler func(ctx context.Context, request Request) Response
+
+type Request struct {
+	// Name of the endpoint, such as "VolumeDriver.Mount"
+	Endpoint string
+	// The decoded request (such as forwarder.MountVolumeRequest), or nil for endpoints that take none
+	Body interface{}
+}
+
+type Response struct {
+	// The response to encode (such as forwarder.GetPathResponse)
+	Body interface{}
+}
+
+/*
+ * Returns the error reported to docker by the response, if any.
+ */
+func (r Response) Err() string {
+	return responseErr(r.Body)
+}
+
+/*
+ * A response that fails the request with the given error. Docker only looks at "Err" when it's set, so this works
+ * for any endpoint.
+ */
+func ErrorResponse(err string) Response {
+	return Response{Body: forwarder.VolumeResponse{Err: err}}
+}
+
+/*
+ * Adds middleware to the end of the chain. Must be called before Listen().
+ */
+func (l *listener) Use(middleware ...Middleware) {
+	l.middleware = append(l.middleware, middleware...)
+	l.chain = l.invoke
+	for i := len(l.middleware) - 1; i >= 0; i-- {
+		m, next := l.middleware[i], l.chain
+		l.chain = func(ctx context.Context, request Request) Response {
+			return m.Handle(ctx, request, next)
+		}
+	}
+}
+
+/*
+ * The end of the chain, which invokes the forwarder.
+ */
+func (l *listener) invoke(ctx context.Context, request Request) Response {
+	return Response{Body: l.endpoints[request.Endpoint].invoke(ctx, request.Body)}
+}
+
+/*
+ * Runs the request through the middleware chain, turning any panic into an error.
+ */
+func (l *listener) serve(ctx context.Context, request Request) (response Response, err error) {
+	defer func() {
+		if p := recover(); p != nil {
+			l.logger.Error("panic while handling request", logging.Endpoint(request.Endpoint),
+				logging.F("panic", fmt.Sprint(p)), logging.F("stack", string(debug.Stack())))
+			err = fmt.Errorf("internal error handling %s: %v", request.Endpoint, p)
+		}
+	}()
+	return l.chain(ctx, request), nil
+}
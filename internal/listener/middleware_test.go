@@ -0,0 +1,120 @@
+/*
+ * Copyright The Titan Project Contributors.
+ */
+
+package listener
+
+import (
+	"bytes"
+	"context"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/titan-data/titan-docker-proxy/internal/forwarder"
+	"github.com/titan-data/titan-docker-proxy/internal/logging"
+	"net/http"
+	"testing"
+)
+
+func recordingMiddleware(name string, calls *[]string) Middleware {
+	return MiddlewareFunc(func(ctx context.Context, request Request, next Handler) Response {
+		*calls = append(*calls, name+" before")
+		response := next(ctx, request)
+		*calls = append(*calls, name+" after")
+		return response
+	})
+}
+
+func TestMiddlewareOrder(t *testing.T) {
+	f := new(MockForwarder)
+	f.On("ListVolumes").Return(forwarder.ListVolumeResponse{})
+	l := create(f, "/socket")
+	calls := []string{}
+	l.Use(recordingMiddleware("first", &calls))
+	l.Use(recordingMiddleware("second", &calls), recordingMiddleware("third", &calls))
+
+	rr := serve(l, "POST", "/VolumeDriver.List", "")
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.Equal(t, []string{"first before", "second before", "third before", "third after", "second after",
+		"first after"}, calls)
+	f.AssertExpectations(t)
+}
+
+func TestMiddlewareSeesRequestAndResponse(t *testing.T) {
+	f := new(MockForwarder)
+	f.On("MountVolume", mock.Anything).Return(forwarder.GetPathResponse{Err: "no such volume"})
+	l := create(f, "/socket")
+	var seen Request
+	var seenErr string
+	l.Use(MiddlewareFunc(func(ctx context.Context, request Request, next Handler) Response {
+		seen = request
+		response := next(ctx, request)
+		seenErr = response.Err()
+		return response
+	}))
+
+	serve(l, "POST", "/VolumeDriver.Mount", "{\"Name\":\"foo/vol\",\"ID\":\"0\"}")
+	assert.Equal(t, forwarder.EndpointMount, seen.Endpoint)
+	assert.Equal(t, forwarder.MountVolumeRequest{Name: "foo/vol", ID: "0"}, seen.Body)
+	assert.Equal(t, "no such volume", seenErr)
+}
+
+func TestMiddlewareShortCircuit(t *testing.T) {
+	f := new(MockForwarder)
+	l := create(f, "/socket")
+	l.Use(MiddlewareFunc(func(ctx context.Context, request Request, next Handler) Response {
+		if request.Endpoint == forwarder.EndpointRemove {
+			return ErrorResponse("volumes cannot be removed")
+		}
+		return next(ctx, request)
+	}))
+
+	rr := serve(l, "POST", "/VolumeDriver.Remove", "{\"Name\":\"foo/vol\"}")
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.Equal(t, "{\"Err\":\"volumes cannot be removed\"}", rr.Body.String())
+	f.AssertExpectations(t)
+}
+
+func TestMiddlewareWrongRequestType(t *testing.T) {
+	f := new(MockForwarder)
+	l := create(f, "/socket")
+	l.Use(MiddlewareFunc(func(ctx context.Context, request Request, next Handler) Response {
+		request.Body = forwarder.VolumeRequest{Name: "foo/vol"}
+		return next(ctx, request)
+	}))
+
+	rr := serve(l, "POST", "/VolumeDriver.Mount", "{\"Name\":\"foo/vol\",\"ID\":\"0\"}")
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.Equal(t, "{\"Err\":\"invalid request of type forwarder.VolumeRequest\"}", rr.Body.String())
+	f.AssertExpectations(t)
+}
+
+func TestPanicRecovered(t *testing.T) {
+	f := new(MockForwarder)
+	f.On("RemoveVolume", mock.Anything).Run(func(args mock.Arguments) {
+		panic("boom")
+	})
+	var buf bytes.Buffer
+	l := create(f, "/socket")
+	l.SetLogger(logging.New(&buf, logging.LevelInfo, logging.FormatText))
+
+	rr := serve(l, "POST", "/VolumeDriver.Remove", "{\"Name\":\"foo/vol\"}")
+	assert.Equal(t, http.StatusInternalServerError, rr.Code)
+	assert.Equal(t, "{\"Err\":\"internal error handling VolumeDriver.Remove: boom\"}", rr.Body.String())
+	assert.Contains(t, buf.String(), "level=error msg=\"panic while handling request\" "+
+		"endpoint=VolumeDriver.Remove panic=boom stack=")
+	assert.Contains(t, buf.String(), "level=info msg=\"request failed\" endpoint=VolumeDriver.Remove ")
+}
+
+func TestPanicInMiddlewareRecovered(t *testing.T) {
+	f := new(MockForwarder)
+	l := create(f, "/socket")
+	l.SetLogger(logging.Discard())
+	l.Use(MiddlewareFunc(func(ctx context.Context, request Request, next Handler) Response {
+		panic("middleware failed")
+	}))
+
+	rr := serve(l, "POST", "/VolumeDriver.List", "")
+	assert.Equal(t, http.StatusInternalServerError, rr.Code)
+	assert.Equal(t, "{\"Err\":\"internal error handling VolumeDriver.List: middleware failed\"}", rr.Body.String())
+	f.AssertExpectations(t)
+}
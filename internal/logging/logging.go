@@ -0,0 +1,263 @@
+/*
+ * Copyright The Titan Project Contributors.
+ */
+
+package logging
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+/*
+ * A small structured logger shared by the listener and the forwarder. Every message has a level and an optional set
+ * of fields, and is written as a single line, either as logfmt-style text or as a JSON object. Loggers derived with
+ * With() share the output of their parent, so lines from concurrent requests never interleave.
+ */
+type Logger struct {
+	out    *output
+	level  Level
+	format Format
+	fields []Field
+}
+
+type output struct {
+	lock sync.Mutex
+	w    io.Writer
+	now  func() time.Time
+}
+
+type Level int
+
+const (
+	LevelDebug Level = iota
+	LevelInfo
+	LevelWarn
+	LevelError
+)
+
+var levelNames = []string{"debug", "info", "warn", "error"}
+
+func (l Level) String() string {
+	if l < LevelDebug || l > LevelError {
+		return fmt.Sprintf("level(%d)", int(l))
+	}
+	return levelNames[l]
+}
+
+func ParseLevel(name string) (Level, error) {
+	for i, levelName := range levelNames {
+		if strings.EqualFold(name, levelName) {
+			return Level(i), nil
+		}
+	}
+	return LevelInfo, fmt.Errorf("invalid log level '%s', must be one of %s", name, strings.Join(levelNames, ", "))
+}
+
+type Format string
+
+const (
+	FormatText Format = "text"
+	FormatJSON Format = "json"
+)
+
+func ParseFormat(name string) (Format, error) {
+	switch Format(name) {
+	case FormatText, FormatJSON:
+		return Format(name), nil
+	}
+	return FormatText, fmt.Errorf("invalid log format '%s', must be one of %s, %s", name, FormatText, FormatJSON)
+}
+
+type Field struct {
+	Key   string
+	Value interface{}
+}
+
+func F(key string, value interface{}) Field {
+	return Field{Key: key, Value: value}
+}
+
+/*
+ * Fields with well-known names, so that the same thing is called the same way everywhere.
+ */
+func Endpoint(endpoint string) Field {
+	return Field{Key: "endpoint", Value: endpoint}
+}
+
+func Volume(name string) Field {
+	return Field{Key: "volume", Value: name}
+}
+
+func Repository(name string) Field {
+	return Field{Key: "repository", Value: name}
+}
+
+func MountID(id string) Field {
+	return Field{Key: "mountId", Value: id}
+}
+
+func Duration(d time.Duration) Field {
+	return Field{Key: "duration", Value: d}
+}
+
+func StatusCode(code int) Field {
+	return Field{Key: "status", Value: code}
+}
+
+func Error(err error) Field {
+	return Field{Key: "error", Value: err}
+}
+
+func New(w io.Writer, level Level, format Format) *Logger {
+	return &Logger{
+		out:    &output{w: w, now: time.Now},
+		level:  level,
+		format: format,
+	}
+}
+
+var defaultLogger = New(os.Stderr, LevelInfo, FormatText)
+
+/*
+ * Logs informational messages and above to stderr as text.
+ */
+func Default() *Logger {
+	return defaultLogger
+}
+
+/*
+ * Discards everything, primarily for testing.
+ */
+func Discard() *Logger {
+	return New(ioutil.Discard, LevelError+1, FormatText)
+}
+
+/*
+ * Returns a logger that adds the given fields to every message.
+ */
+func (l *Logger) With(fields ...Field) *Logger {
+	derived := *l
+	derived.fields = append(append([]Field{}, l.fields...), fields...)
+	return &derived
+}
+
+func (l *Logger) Enabled(level Level) bool {
+	return level >= l.level
+}
+
+func (l *Logger) Debug(msg string, fields ...Field) {
+	l.log(LevelDebug, msg, fields)
+}
+
+func (l *Logger) Info(msg string, fields ...Field) {
+	l.log(LevelInfo, msg, fields)
+}
+
+func (l *Logger) Warn(msg string, fields ...Field) {
+	l.log(LevelWarn, msg, fields)
+}
+
+func (l *Logger) Error(msg string, fields ...Field) {
+	l.log(LevelError, msg, fields)
+}
+
+func (l *Logger) log(level Level, msg string, fields []Field) {
+	if !l.Enabled(level) {
+		return
+	}
+
+	all := append(append([]Field{}, l.fields...), fields...)
+	var line []byte
+	if l.format == FormatJSON {
+		line = l.formatJSON(level, msg, all)
+	} else {
+		line = l.formatText(level, msg, all)
+	}
+
+	l.out.lock.Lock()
+	defer l.out.lock.Unlock()
+	l.out.w.Write(line)
+}
+
+func (l *Logger) timestamp() string {
+	return l.out.now().UTC().Format("2006-01-02T15:04:05.000Z07:00")
+}
+
+/*
+ * Converts field values to something that reads well in both formats.
+ */
+func fieldValue(value interface{}) interface{} {
+	switch v := value.(type) {
+	case error:
+		if v == nil {
+			return nil
+		}
+		return v.Error()
+	case time.Duration:
+		return v.String()
+	case fmt.Stringer:
+		return v.String()
+	}
+	return value
+}
+
+func (l *Logger) formatText(level Level, msg string, fields []Field) []byte {
+	var buf bytes.Buffer
+	buf.WriteString("time=")
+	buf.WriteString(l.timestamp())
+	buf.WriteString(" level=")
+	buf.WriteString(level.String())
+	buf.WriteString(" msg=")
+	buf.WriteString(quoteText(msg))
+	for _, field := range fields {
+		buf.WriteByte(' ')
+		buf.WriteString(field.Key)
+		buf.WriteByte('=')
+		buf.WriteString(quoteText(fmt.Sprint(fieldValue(field.Value))))
+	}
+	buf.WriteByte('\n')
+	return buf.Bytes()
+}
+
+func quoteText(value string) string {
+	if value == "" || strings.ContainsAny(value, " =\"\\\t\r\n") {
+		return strconv.Quote(value)
+	}
+	return value
+}
+
+func (l *Logger) formatJSON(level Level, msg string, fields []Field) []byte {
+	var buf bytes.Buffer
+	writeJSON := func(key string, value interface{}) {
+		encodedKey, _ := json.Marshal(key)
+		encoded, err := json.Marshal(value)
+		if err != nil {
+			encoded, _ = json.Marshal(fmt.Sprint(value))
+		}
+		buf.Write(encodedKey)
+		buf.WriteByte(':')
+		buf.Write(encoded)
+	}
+
+	buf.WriteByte('{')
+	writeJSON("time", l.timestamp())
+	buf.WriteByte(',')
+	writeJSON("level", level.String())
+	buf.WriteByte(',')
+	writeJSON("msg", msg)
+	for _, field := range fields {
+		buf.WriteByte(',')
+		writeJSON(field.Key, fieldValue(field.Value))
+	}
+	buf.WriteString("}\n")
+	return buf.Bytes()
+}
@@ -0,0 +1,72 @@
+/*
+ * Copyright The Titan Project Contributors.
+ */
+
+package logging
+
+import (
+	"bytes"
+	"errors"
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+func testLogger(level Level, format Format) (*Logger, *bytes.Buffer) {
+	var buf bytes.Buffer
+	l := New(&buf, level, format)
+	l.out.now = func() time.Time {
+		return time.Date(2020, 1, 2, 3, 4, 5, 6000000, time.UTC)
+	}
+	return l, &buf
+}
+
+func TestText(t *testing.T) {
+	l, buf := testLogger(LevelInfo, FormatText)
+	l.Info("request failed", Endpoint("VolumeDriver.Mount"), Volume("foo/vol"), MountID("abc"),
+		Duration(1500*time.Millisecond), StatusCode(500), Error(errors.New("no such volume")))
+	assert.Equal(t, "time=2020-01-02T03:04:05.006Z level=info msg=\"request failed\" endpoint=VolumeDriver.Mount "+
+		"volume=foo/vol mountId=abc duration=1.5s status=500 error=\"no such volume\"\n", buf.String())
+}
+
+func TestJSON(t *testing.T) {
+	l, buf := testLogger(LevelInfo, FormatJSON)
+	l.Warn("slow", Volume("foo/vol"), Duration(time.Second), StatusCode(200), F("empty", ""))
+	assert.Equal(t, "{\"time\":\"2020-01-02T03:04:05.006Z\",\"level\":\"warn\",\"msg\":\"slow\","+
+		"\"volume\":\"foo/vol\",\"duration\":\"1s\",\"status\":200,\"empty\":\"\"}\n", buf.String())
+}
+
+func TestLevels(t *testing.T) {
+	l, buf := testLogger(LevelWarn, FormatText)
+	l.Debug("debug")
+	l.Info("info")
+	assert.Empty(t, buf.String())
+	assert.False(t, l.Enabled(LevelInfo))
+	assert.True(t, l.Enabled(LevelError))
+
+	l.Error("error")
+	assert.Contains(t, buf.String(), "level=error msg=error")
+}
+
+func TestWith(t *testing.T) {
+	l, buf := testLogger(LevelDebug, FormatText)
+	derived := l.With(Endpoint("VolumeDriver.Get"))
+	derived.Debug("one", Volume("a"))
+	l.Debug("two")
+	assert.Equal(t, "time=2020-01-02T03:04:05.006Z level=debug msg=one endpoint=VolumeDriver.Get volume=a\n"+
+		"time=2020-01-02T03:04:05.006Z level=debug msg=two\n", buf.String())
+}
+
+func TestParse(t *testing.T) {
+	level, err := ParseLevel("WARN")
+	assert.NoError(t, err)
+	assert.Equal(t, LevelWarn, level)
+	_, err = ParseLevel("verbose")
+	assert.Error(t, err)
+
+	format, err := ParseFormat("json")
+	assert.NoError(t, err)
+	assert.Equal(t, FormatJSON, format)
+	_, err = ParseFormat("xml")
+	assert.Error(t, err)
+}